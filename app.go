@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"time"
 
 	"gioui.org/app"
@@ -16,15 +21,17 @@ import (
 )
 
 type App struct {
-	node       *p2p.Node
-	ui         *UI
-	settings   Settings
-	appEvents  chan p2p.Message
-	nodeEvents chan p2p.Message
-
-	currentResponse p2p.TransferResponse
-	requestSender   string
+	node     *p2p.Node
+	ui       *UI
+	settings Settings
+	uiEvents chan UIEvent
+
+	control      *controlServer // nil unless the user turned it on
+	controlCalls chan func()
+
+	requests        []p2p.TransferRequested // waiting for the user, oldest first
 	currentTransfer string
+	pairingPeer     string // the peer whose pairing code is being shown
 
 	bridge *OSBridge
 
@@ -35,17 +42,44 @@ type App struct {
 func NewApp(bridge *OSBridge) App {
 	ctx, cancel := context.WithCancel(context.Background())
 	a := App{
-		settings:   loadSettings(),
-		appEvents:  make(chan p2p.Message),
-		nodeEvents: make(chan p2p.Message),
-		ctx:        ctx,
-		cancel:     cancel,
-		bridge:     bridge,
-	}
-	a.ui = NewUI(&a.settings, a.appEvents, bridge != nil)
-	a.node = p2p.NewNode(ctx, &a.ui.settings.DownloadPath,
-		a.appEvents, a.nodeEvents)
-	go a.handleAppEvents()
+		settings:     loadSettings(),
+		uiEvents:     make(chan UIEvent),
+		controlCalls: make(chan func()),
+		ctx:          ctx,
+		cancel:       cancel,
+		bridge:       bridge,
+	}
+	a.ui = NewUI(&a.settings, a.uiEvents, bridge != nil)
+	dataFolder := filepath.Join(filepath.Dir(a.settings.path), "drip")
+
+	iceServers, err := p2p.ParseICEServers(a.settings.ICEServers)
+	if err != nil {
+		a.ui.AddError(fmt.Sprintf("Invalid ICE servers: %v", err))
+	}
+	a.node, err = p2p.NewNode(ctx, p2p.NodeConfig{
+		DataFolder:     dataFolder,
+		DisplayName:    a.settings.DisplayName,
+		DownloadFolder: &a.ui.settings.DownloadPath,
+		Port:           a.settings.Port,
+		Network: p2p.NetworkConfig{
+			LanOnly:    a.settings.LanOnly.Value,
+			ICEServers: iceServers,
+		},
+		Discovery: p2p.DiscoveryConfig{StaticPeers: a.settings.StaticPeers},
+		Limits:    a.settings.rateLimits(),
+		LocalSend: p2p.LocalSendConfig{Enabled: a.settings.LocalSend.Value},
+	})
+	if err != nil {
+		panic(err) // there's nothing to do without a node
+	}
+
+	if a.settings.ControlAPI.Value {
+		a.control, err = startControlServer(&a, dataFolder, a.settings.ControlPort)
+		if err != nil {
+			a.ui.AddError(fmt.Sprintf("Couldn't start the control api: %v", err))
+		}
+	}
+	go a.handleEvents()
 	return a
 }
 
@@ -78,100 +112,375 @@ func (a *App) Launch() {
 
 func (a *App) Shutdown() {
 	a.cancel()
+	if a.control != nil {
+		a.control.close()
+	}
 	a.node.Shutdown()
 	saveSettings(a.settings)
-	close(a.appEvents)
-	close(a.nodeEvents)
 }
 
-func (a *App) sendFiles() {
-	recipients := []string{}
-	for _, peer := range a.ui.recipients {
-		if peer.check.Value {
-			recipients = append(recipients, peer.name)
-		}
+// Turn the files and folders the user picked into files the node can send
+func (a *App) selectedFiles() (map[string]*p2p.File, bool) {
+	policy := p2p.PRESERVE_SYMLINKS
+	if a.settings.FollowSymlinks.Value {
+		policy = p2p.FOLLOW_SYMLINKS
 	}
 
 	files := map[string]*p2p.File{}
 	for _, file := range a.ui.files {
-		f := p2p.NewReaderFile(file.name, file.size, file.rc)
-		files[file.name] = f
+		if file.path == "" {
+			files[file.name] = p2p.NewReaderFile(file.name, file.size, file.rc)
+			continue
+		}
+
+		entries, err := p2p.NewDirectoryFiles(file.path, policy)
+		if err != nil {
+			a.ui.AddError(fmt.Sprintf("Couldn't read %s", file.name))
+			return nil, false
+		}
+		maps.Copy(files, entries)
 	}
+	return files, true
+}
 
-	a.currentTransfer = a.node.SendFiles(recipients, files)
+func (a *App) sendFiles() {
+	files, ok := a.selectedFiles()
+	if !ok {
+		return
+	}
+	a.currentTransfer = a.node.SendFiles(a.ui.selectedRecipients(), files)
 	a.ui.currentPage = PROGRESS_PAGE
 	a.ui.sendingMsg = "Pending authorization"
+	a.ui.sendingDone = false
+	a.ui.sendingPaused = false
+}
+
+// Share the selected files with browsers, which can also send files back
+func (a *App) shareFiles() {
+	files, ok := a.selectedFiles()
+	if !ok {
+		return
+	}
+	link, err := a.node.ShareFiles(files, 0)
+	if err != nil {
+		a.ui.AddError(fmt.Sprintf("Couldn't share the files: %v", err))
+		return
+	}
+	if err := a.ui.ShowShareLink(link); err != nil {
+		a.node.StopSharing()
+		a.ui.AddError(fmt.Sprintf("Couldn't show the link: %v", err))
+	}
+}
+
+// Add a device by its address, or by its pairing code which also pairs with it
+func (a *App) addPeer(value string) error {
+	if strings.HasPrefix(value, "drip://") {
+		return a.node.AddPeerFromPayload(value)
+	}
+	return a.node.AddPeer(value)
+}
 
-	go a.updateFileProgresses()
+// Something like "2.1 MB/s · 12s left"
+func describeProgress(p p2p.Progress) string {
+	if p.Throughput <= 0 {
+		return ""
+	}
+	msg := fmt.Sprintf("%s/s", p2p.FormatBytes(p.Throughput))
+	if p.ETA > 0 {
+		msg += fmt.Sprintf(" · %s left", p.ETA.Round(time.Second))
+	}
+	return msg
 }
 
-func (a *App) updateFileProgresses() {
-	for a.ui.currentPage == PROGRESS_PAGE {
-		report := a.node.GetProgressReport(a.currentTransfer)
-		a.ui.UpdateFileProgresses(report.Percentages)
+func (a *App) showProgress(event p2p.TransferProgress) {
+	report := event.Report
+	if !event.Sending {
+		a.ui.UpdateIncoming(event.TransferId, a.ui.PeerName(event.PeerId), report)
+		return
+	}
 
-		if report.Done {
-			a.ui.sendingMsg = "Done sending files"
-		} else if report.Started {
-			a.ui.sendingMsg = "Sending files"
+	if event.TransferId != a.currentTransfer || a.ui.currentPage != PROGRESS_PAGE {
+		return
+	}
+	// give up once nobody is getting the files
+	abandoned := len(report.Recipients) > 0
+	receiving := 0
+	for _, recipient := range report.Recipients {
+		if recipient.State != p2p.RECIPIENT_REJECTED && recipient.State != p2p.RECIPIENT_FAILED {
+			abandoned = false
+			receiving++
 		}
+	}
+	if abandoned {
+		a.ui.ForgetCurrentTransfer(false, false)
+		return
+	}
 
-		time.Sleep(time.Second)
+	a.ui.UpdateFileProgresses(report.Files)
+	a.ui.sendingPaused = report.Paused
+	pausedBy := []string{}
+	for id, recipient := range report.Recipients {
+		if recipient.Paused {
+			pausedBy = append(pausedBy, a.ui.PeerName(id))
+		}
+	}
+
+	if report.Done {
+		a.ui.sendingMsg = "Done sending files"
+		a.ui.sendingDone = true
+	} else if report.Paused {
+		a.ui.sendingMsg = "Paused"
+	} else if len(pausedBy) > 0 {
+		slices.Sort(pausedBy)
+		a.ui.sendingMsg = fmt.Sprintf("Paused by %s", strings.Join(pausedBy, ", "))
+	} else if report.Started {
+		a.ui.sendingMsg = "Sending files"
+		if receiving < len(report.Recipients) {
+			a.ui.sendingMsg = fmt.Sprintf("Sending files to %d of %d devices",
+				receiving, len(report.Recipients))
+		}
+		if stats := describeProgress(report.Progress); stats != "" {
+			a.ui.sendingMsg += " · " + stats
+		}
 	}
 }
 
-func (a *App) handleAppEvents() {
-	for event := range a.appEvents {
-		switch event.Type {
-		case p2p.SEND_FILES:
-			a.sendFiles()
+// Ask the user about the oldest request, unless they're busy pairing
+func (a *App) showNextRequest() {
+	if a.pairingPeer != "" {
+		return
+	}
+	if len(a.requests) == 0 {
+		a.ui.showAuthPopup = false
+		a.ui.SetRequestFiles(nil)
+		return
+	}
 
-		case p2p.TRANSFER_CANCELLED:
-			a.node.CancelTransfer(a.currentTransfer)
-			a.currentTransfer = ""
+	request := a.requests[0]
+	a.ui.showAuthPopup = true
+	a.ui.SetRequestFiles(request.Files)
+	a.ui.authMsg = fmt.Sprintf("%s (%d files, %s)",
+		request.Message, len(request.Files), p2p.FormatBytes(float64(request.TotalSize)))
+	if waiting := len(a.requests) - 1; waiting > 0 {
+		a.ui.authMsg += fmt.Sprintf(" (%d more waiting)", waiting)
+	}
+}
 
-		case p2p.TRANSFER_REJECTED:
-			a.ui.ForgetCurrentTransfer(false, false)
-			a.ui.AddError("Transfer was rejected")
+// Turn an error from the node into something the user can read
+func (a *App) describeError(err p2p.Error) string {
+	peer := a.ui.PeerName(err.PeerId)
+	if peer == "" {
+		peer = "a device"
+	}
+	switch err.Kind {
+	case p2p.NETWORK_ERROR:
+		if err.PeerId == "" {
+			return fmt.Sprintf("Network error: %s", err.Message)
+		}
+		return fmt.Sprintf("Lost the connection to %s: %s", peer, err.Message)
+	case p2p.PROTOCOL_ERROR:
+		return fmt.Sprintf("Got an invalid message from %s", peer)
+	case p2p.STORAGE_ERROR:
+		return fmt.Sprintf("Couldn't read or save files: %s", err.Message)
+	}
+	return err.Error()
+}
 
-		case p2p.ADDED_PEER, p2p.REMOVED_PEER:
-			peer, err := p2p.Deserialize[string](event)
-			if err != nil {
-				panic(err)
+func (a *App) handleEvents() {
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case event := <-a.uiEvents:
+			a.handleUIEvent(event)
+		case call := <-a.controlCalls:
+			call()
+		case event := <-a.node.Events():
+			a.handleNodeEvent(event)
+			if a.control != nil {
+				a.control.publish(event)
 			}
-			a.ui.UpdateRecipients(peer, event.Type == p2p.REMOVED_PEER)
+		}
+	}
+}
 
-		case p2p.NOTIFY_COMPLETION:
-			msg, err := p2p.Deserialize[string](event)
-			if err != nil {
-				panic(err)
+func (a *App) handleUIEvent(event UIEvent) {
+	switch event.Type {
+	case SEND_FILES:
+		a.sendFiles()
+
+	case CANCEL_TRANSFER:
+		if receiving, _ := event.Value.(bool); receiving {
+			for _, id := range a.ui.incomingTransfers() {
+				a.node.CancelTransfer(id)
+				a.ui.ForgetIncoming(id)
 			}
-			notifier, _ := notify.NewNotifier()
-			_, _ = notifier.CreateNotification("Transfer status", msg)
-
-		case p2p.TRANSFER_REQUEST:
-			// show the request to the user
-			request, err := p2p.Deserialize[p2p.TransferRequest](event)
-			if err != nil {
-				panic(err)
+			break
+		}
+		a.node.CancelTransfer(a.currentTransfer)
+		a.currentTransfer = ""
+
+	case PAUSE_TRANSFER, UNPAUSE_TRANSFER:
+		ids := []string{a.currentTransfer}
+		if receiving, _ := event.Value.(bool); receiving {
+			ids = a.ui.incomingTransfers()
+		}
+		for _, id := range ids {
+			if event.Type == PAUSE_TRANSFER {
+				a.node.PauseTransfer(id)
+			} else {
+				a.node.UnpauseTransfer(id)
 			}
-			a.currentResponse = p2p.TransferResponse{TransferId: request.TransferId}
-			a.requestSender = request.Sender
-			a.ui.showAuthPopup = true
-			a.ui.authMsg = request.Message
-
-		case p2p.AUTH_GRANTED:
-			// relay back the user's choice
-			authorized, err := p2p.Deserialize[bool](event)
-			if err != nil {
-				panic(err)
+		}
+
+	case RENAME_DEVICE:
+		if err := a.node.SetDisplayName(event.Value.(string)); err != nil {
+			a.ui.AddError("Couldn't change the device name")
+		}
+
+	case SET_RATE_LIMITS:
+		a.node.SetRateLimits(a.settings.rateLimits())
+
+	case PAIR_DEVICE:
+		a.node.Pair(event.Value.(string))
+
+	case SHARE_FILES:
+		a.shareFiles()
+
+	case STOP_SHARING:
+		a.node.StopSharing()
+
+	case SHOW_PAIRING_CODE:
+		if err := a.ui.ShowPairingCode(a.node.PairingPayload().String()); err != nil {
+			a.ui.AddError(fmt.Sprintf("Couldn't show the pairing code: %v", err))
+		}
+
+	case ADD_PEER:
+		if err := a.addPeer(event.Value.(string)); err != nil {
+			a.ui.AddError(fmt.Sprintf("Couldn't add the device: %v", err))
+		}
+
+	case AUTH_GRANTED:
+		// relay back the user's choice
+		authorized := event.Value.(bool)
+		a.ui.showAuthPopup = false
+
+		if a.pairingPeer != "" {
+			a.node.ConfirmPairing(a.pairingPeer, authorized)
+			a.pairingPeer = ""
+			a.showNextRequest()
+			break
+		}
+
+		if len(a.requests) > 0 {
+			id := a.requests[0].TransferId
+			files, all := a.ui.acceptedFiles()
+			if authorized && !all {
+				a.node.AcceptFiles(id, files)
+			} else {
+				a.node.RespondToRequest(id, authorized)
 			}
+			a.requests = a.requests[1:]
+		}
+		a.showNextRequest()
+	}
+}
+
+func (a *App) handleNodeEvent(event p2p.Event) {
+	switch event := event.(type) {
+	case p2p.PeerAdded:
+		a.ui.UpdateRecipients(event.Peer, false)
+
+	case p2p.PeerUpdated:
+		a.ui.UpdateRecipients(event.Peer, false)
+
+	case p2p.PeerRemoved:
+		a.ui.UpdateRecipients(p2p.PeerInfo{Id: event.PeerId}, true)
+
+	case p2p.Error:
+		a.ui.AddError(a.describeError(event))
+
+	case p2p.TransferRequested:
+		// no need to ask about devices we've paired with
+		if event.Trusted && a.settings.TrustPeers.Value {
+			a.node.RespondToRequest(event.TransferId, true)
+			break
+		}
+
+		// ask the user once they've answered the requests before it
+		a.requests = append(a.requests, event)
+		a.showNextRequest()
+
+	case p2p.RequestExpired:
+		a.requests = slices.DeleteFunc(a.requests, func(r p2p.TransferRequested) bool {
+			return r.TransferId == event.TransferId
+		})
+		a.showNextRequest()
+		a.ui.AddError(fmt.Sprintf(
+			"Declined files from %s since nobody answered", a.ui.PeerName(event.PeerId)))
+
+	case p2p.TransferProgress:
+		a.showProgress(event)
 
-			a.ui.showAuthPopup = false
-			a.currentResponse.Authorized = authorized
-			msg := p2p.NewMessage(p2p.TRANSFER_RESPONSE, a.currentResponse)
-			msg.Recipients = []string{a.requestSender}
-			a.nodeEvents <- msg
+	case p2p.TransferCompleted:
+		msg := fmt.Sprintf("Received %d from %s", event.Files, event.SenderName)
+		notifier, _ := notify.NewNotifier()
+		_, _ = notifier.CreateNotification("Transfer status", msg)
+
+	case p2p.TransferFailed:
+		if event.Cancelled {
+			a.ui.ForgetIncoming(event.TransferId)
+			if len(a.ui.incoming) == 0 && a.ui.currentPage == RECEIVING_PAGE {
+				a.ui.currentPage = HOME_PAGE
+			}
+			a.ui.AddError(fmt.Sprintf(
+				"%s cancelled the transfer", a.ui.PeerName(event.PeerId)))
+			break
+		}
+		if !event.Rejected {
+			a.ui.ForgetIncoming(event.TransferId)
+			a.ui.AddError(fmt.Sprintf("Files from %s weren't received: %s",
+				a.ui.PeerName(event.PeerId), event.Reason))
+			break
 		}
+
+		// the others keep getting the files
+		name := a.ui.PeerName(event.PeerId)
+		if event.TimedOut {
+			a.ui.AddError(fmt.Sprintf("%s didn't answer in time", name))
+		} else if event.Reason == "" {
+			a.ui.AddError(fmt.Sprintf("%s rejected the transfer", name))
+		} else {
+			a.ui.AddError(fmt.Sprintf("%s rejected the transfer: %s", name, event.Reason))
+		}
+
+	case p2p.PairingRequested:
+		a.pairingPeer = event.PeerId
+		a.ui.showAuthPopup = true
+		a.ui.SetRequestFiles(nil)
+		a.ui.authMsg = fmt.Sprintf(
+			"Pair with %s? Make sure it shows %s",
+			a.ui.PeerName(event.PeerId), event.Code)
+
+	case p2p.Paired:
+		notifier, _ := notify.NewNotifier()
+		_, _ = notifier.CreateNotification(
+			"Pairing status", fmt.Sprintf("Paired with %s", a.ui.PeerName(event.PeerId)))
+
+	case p2p.PairingFailed:
+		a.ui.AddError(fmt.Sprintf("Couldn't pair with %s", a.ui.PeerName(event.PeerId)))
+
+	case p2p.ShareExpired:
+		if a.ui.currentPage == SHARE_PAGE {
+			a.ui.currentPage = HOME_PAGE
+		}
+		a.ui.AddError("The share link expired")
+
+	case p2p.PeerImpersonated:
+		a.ui.AddError(fmt.Sprintf(
+			"%s isn't the device you paired with", a.ui.PeerName(event.PeerId)))
+	case p2p.PeerLookAlike:
+		a.ui.AddError(fmt.Sprintf(
+			"A device you haven't paired with is also called %s", a.ui.PeerName(event.PeerId)))
 	}
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aabiji/drip/p2p"
+)
+
+// Print the peers that show up within the wait time
+func listPeers(ctx context.Context, node *p2p.Node, out *printer, opts options) error {
+	timeout := time.After(opts.wait)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout:
+			return nil
+		case event := <-node.Events():
+			switch event.(type) {
+			case p2p.PeerAdded, p2p.PeerUpdated:
+				out.event(event)
+			default:
+				out.track(event)
+			}
+		}
+	}
+}
+
+func send(
+	ctx context.Context, node *p2p.Node, out *printer,
+	opts options, query string, paths []string) error {
+	policy := p2p.PRESERVE_SYMLINKS
+	if opts.followSymlinks {
+		policy = p2p.FOLLOW_SYMLINKS
+	}
+	files, err := collectFiles(paths, policy)
+	if err != nil {
+		return err
+	}
+
+	peerId, err := findPeer(ctx, node, out, query, opts.wait)
+	if err != nil {
+		return err
+	}
+	transferId := node.SendFiles([]string{peerId}, files)
+	out.note("waiting for %s to accept %d files", out.name(peerId), len(files))
+
+	for {
+		select {
+		case <-ctx.Done():
+			node.CancelTransfer(transferId)
+			return errors.New("cancelled")
+
+		case event := <-node.Events():
+			switch event := event.(type) {
+			case p2p.TransferProgress:
+				if event.TransferId != transferId {
+					continue
+				}
+				out.event(event)
+
+			case p2p.TransferDelivered:
+				// done sending only means it's all been handed to the connection
+				if event.TransferId == transferId {
+					out.event(event)
+					return nil
+				}
+
+			case p2p.TransferFailed:
+				if event.TransferId == transferId {
+					return errors.New(describeFailure(out.name(event.PeerId), event))
+				}
+
+			case p2p.Error:
+				out.event(event)
+				if event.TransferId == transferId {
+					return event
+				}
+
+			case p2p.TransferRequested:
+				// we're only here to send
+				node.RespondToRequest(event.TransferId, false)
+
+			default:
+				out.track(event)
+			}
+		}
+	}
+}
+
+// Read the files and folders to send, named after their last path element
+func collectFiles(paths []string, policy p2p.SymlinkPolicy) (map[string]*p2p.File, error) {
+	files := map[string]*p2p.File{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			entries, err := p2p.NewDirectoryFiles(path, policy)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read %s: %w", path, err)
+			}
+			maps.Copy(files, entries)
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(path)
+		files[name] = p2p.NewReaderFile(name, info.Size(), file)
+	}
+	return files, nil
+}
+
+// Wait for a peer whose id or name matches the query to show up
+func findPeer(
+	ctx context.Context, node *p2p.Node, out *printer,
+	query string, wait time.Duration) (string, error) {
+	timeout := time.After(wait)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.New("cancelled")
+		case <-timeout:
+			return "", fmt.Errorf("couldn't find %s on the network", query)
+		case event := <-node.Events():
+			out.track(event)
+			added, ok := event.(p2p.PeerAdded)
+			if !ok {
+				continue
+			}
+			if added.Peer.Id == query || strings.EqualFold(added.Peer.Name, query) {
+				return added.Peer.Id, nil
+			}
+		}
+	}
+}
+
+func receive(ctx context.Context, node *p2p.Node, out *printer, opts options) error {
+	out.note("devices that can't find this one can add it with -add %s", node.PairingPayload())
+	prompt := newPrompter()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event := <-node.Events():
+			out.event(event)
+			switch event := event.(type) {
+			case p2p.TransferRequested:
+				trusted := event.Trusted && opts.autoAccept == "trusted"
+				if trusted || opts.autoAccept == "all" {
+					node.RespondToRequest(event.TransferId, true)
+					out.note("accepted files from %s", out.name(event.PeerId))
+					continue
+				}
+
+				// asking can't hold up the node, it has to keep reading events
+				question := fmt.Sprintf("accept files from %s? [y/N] ", out.name(event.PeerId))
+				go func() {
+					node.RespondToRequest(event.TransferId, prompt.ask(question))
+				}()
+
+			case p2p.TransferCompleted:
+				if opts.once {
+					return nil
+				}
+
+			case p2p.TransferFailed:
+				if opts.once && !event.Rejected {
+					return errors.New(describeFailure(out.name(event.PeerId), event))
+				}
+			}
+		}
+	}
+}
+
+// Print everything until interrupted. Requests are left to time out.
+func watch(ctx context.Context, node *p2p.Node, out *printer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-node.Events():
+			out.event(event)
+		}
+	}
+}
+
+// Asks yes or no questions on the terminal, one at a time
+type prompter struct {
+	input *bufio.Reader
+	mu    sync.Mutex
+}
+
+func newPrompter() *prompter { return &prompter{input: bufio.NewReader(os.Stdin)} }
+
+// Anything but a yes, including there being nobody to answer, is a no
+func (p *prompter) ask(question string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(os.Stderr, question)
+	answer, err := p.input.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
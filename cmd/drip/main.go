@@ -0,0 +1,197 @@
+// Command drip sends and receives files without the gui, for servers,
+// scripts and ssh sessions. It uses the same identity as the app, so
+// devices that were paired with the app trust it too.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aabiji/drip/p2p"
+)
+
+const usage = `usage: drip <command> [flags] [arguments]
+
+commands:
+  peers                   list the devices on the network
+  send <peer> <paths...>  send files and folders to a device, by id or name
+  receive                 accept files from other devices
+  watch                   print everything the node sees, without answering requests
+
+run drip <command> -h to see a command's flags
+`
+
+type options struct {
+	name          string
+	port          int
+	lanOnly       bool
+	json          bool
+	dataFolder    string
+	localSend     bool
+	localSendPort int      // for the LocalSend api
+	peers         []string // addresses and pairing codes of devices to add
+	deviceType    string
+
+	wait           time.Duration // how long to look for peers
+	followSymlinks bool
+	downloadFolder string
+	autoAccept     string
+	once           bool
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	opts := options{}
+	flags := flag.NewFlagSet("drip "+command, flag.ExitOnError)
+	flags.StringVar(&opts.name, "name", p2p.DefaultDisplayName(), "the name other devices see")
+	flags.IntVar(&opts.port, "port", 0, "the port to listen on, picked at random if 0")
+	flags.BoolVar(&opts.lanOnly, "lan-only", false, "never contact anything outside the local network")
+	flags.BoolVar(&opts.json, "json", false, "print one json object per line")
+	flags.StringVar(&opts.dataFolder, "data", defaultDataFolder(), "where the device's identity is kept")
+	flags.BoolVar(&opts.localSend, "localsend", false, "also work with LocalSend apps")
+	flags.IntVar(&opts.localSendPort, "localsend-port", 0, "the port the LocalSend api listens on, 53317 if 0")
+	flags.StringVar(&opts.deviceType, "type", p2p.SERVER_DEVICE,
+		"what other devices show this one as: desktop, phone or server")
+	flags.Func("add", "the host:port or pairing code of a device discovery can't find, can be repeated",
+		func(value string) error {
+			opts.peers = append(opts.peers, value)
+			return nil
+		})
+
+	switch command {
+	case "peers":
+		flags.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to look for devices")
+	case "send":
+		flags.DurationVar(&opts.wait, "wait", 15*time.Second, "how long to wait for the device to show up")
+		flags.BoolVar(&opts.followSymlinks, "follow-symlinks", false, "send the files symlinks point to")
+	case "receive":
+		flags.StringVar(&opts.downloadFolder, "dir", defaultDownloadFolder(), "where received files go")
+		flags.StringVar(&opts.autoAccept, "auto-accept", "",
+			"accept requests without asking: trusted for paired devices, all for everyone")
+		flags.BoolVar(&opts.once, "once", false, "exit after the first transfer")
+	case "watch":
+		flags.StringVar(&opts.downloadFolder, "dir", defaultDownloadFolder(), "where received files go")
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "drip: unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	flags.Parse(args)
+
+	if command == "receive" &&
+		opts.autoAccept != "" && opts.autoAccept != "trusted" && opts.autoAccept != "all" {
+		fmt.Fprintf(os.Stderr, "drip: -auto-accept must be trusted or all\n")
+		os.Exit(2)
+	}
+	if opts.deviceType != p2p.DESKTOP_DEVICE &&
+		opts.deviceType != p2p.PHONE_DEVICE && opts.deviceType != p2p.SERVER_DEVICE {
+		fmt.Fprintf(os.Stderr, "drip: -type must be desktop, phone or server\n")
+		os.Exit(2)
+	}
+	if command == "send" && flags.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: drip send [flags] <peer> <paths...>\n")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	node, err := startNode(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drip: %v\n", err)
+		os.Exit(1)
+	}
+	out := newPrinter(opts.json)
+	for _, peer := range opts.peers {
+		if err := addPeer(node, peer); err != nil {
+			node.Shutdown()
+			fmt.Fprintf(os.Stderr, "drip: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	switch command {
+	case "peers":
+		err = listPeers(ctx, node, out, opts)
+	case "send":
+		err = send(ctx, node, out, opts, flags.Arg(0), flags.Args()[1:])
+	case "receive":
+		err = receive(ctx, node, out, opts)
+	case "watch":
+		err = watch(ctx, node, out)
+	}
+
+	stop()
+	node.Shutdown()
+	if err != nil {
+		out.fail(err)
+		os.Exit(1)
+	}
+}
+
+func startNode(ctx context.Context, opts options) (*p2p.Node, error) {
+	if opts.downloadFolder == "" {
+		opts.downloadFolder = defaultDownloadFolder()
+	}
+	if err := os.MkdirAll(opts.downloadFolder, 0755); err != nil {
+		return nil, err
+	}
+
+	network := p2p.NetworkConfig{LanOnly: opts.lanOnly}
+	if !opts.lanOnly {
+		servers, err := p2p.ParseICEServers(p2p.DefaultICEServers)
+		if err != nil {
+			return nil, err
+		}
+		network.ICEServers = servers
+	}
+
+	return p2p.NewNode(ctx, p2p.NodeConfig{
+		DataFolder:     opts.dataFolder,
+		DisplayName:    opts.name,
+		DownloadFolder: &opts.downloadFolder,
+		Port:           opts.port,
+		Network:        network,
+		LocalSend:      p2p.LocalSendConfig{Enabled: opts.localSend, Port: opts.localSendPort},
+		DeviceType:     opts.deviceType,
+	})
+}
+
+// Add a device by its address, or by its pairing code which also pairs with it
+func addPeer(node *p2p.Node, value string) error {
+	if strings.HasPrefix(value, "drip://") {
+		return node.AddPeerFromPayload(value)
+	}
+	return node.AddPeer(value)
+}
+
+// The same folder the app uses on desktop
+func defaultDataFolder() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "drip"
+	}
+	return filepath.Join(base, "drip")
+}
+
+func defaultDownloadFolder() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "Downloads")
+}
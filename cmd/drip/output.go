@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aabiji/drip/p2p"
+)
+
+// Prints events either for people or, in json mode, as one object per line
+type printer struct {
+	json    bool
+	encoder *json.Encoder
+	names   map[string]string // peer id -> device name
+}
+
+func newPrinter(jsonMode bool) *printer {
+	return &printer{json: jsonMode, encoder: json.NewEncoder(os.Stdout), names: make(map[string]string)}
+}
+
+// The name of a peer, falling back to its id
+func (p *printer) name(peerId string) string {
+	if name, exists := p.names[peerId]; exists && name != "" {
+		return name
+	}
+	return peerId
+}
+
+// Remember the names of the peers we've seen
+func (p *printer) track(event p2p.Event) {
+	switch event := event.(type) {
+	case p2p.PeerAdded:
+		p.names[event.Peer.Id] = event.Peer.Name
+	case p2p.PeerUpdated:
+		p.names[event.Peer.Id] = event.Peer.Name
+	}
+}
+
+func (p *printer) event(event p2p.Event) {
+	p.track(event)
+	if p.json {
+		p.encoder.Encode(struct {
+			Event string
+			Data  p2p.Event
+		}{reflect.TypeOf(event).Name(), event})
+		return
+	}
+	if text := p.describe(event); text != "" {
+		fmt.Println(text)
+	}
+}
+
+// Print something that isn't an event, like an answer to a prompt
+func (p *printer) note(format string, args ...any) {
+	if p.json {
+		p.encoder.Encode(struct{ Note string }{fmt.Sprintf(format, args...)})
+		return
+	}
+	fmt.Printf(format+"\n", args...)
+}
+
+func (p *printer) fail(err error) {
+	if p.json {
+		p.encoder.Encode(struct{ Error string }{err.Error()})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "drip: %v\n", err)
+}
+
+func (p *printer) describe(event p2p.Event) string {
+	switch event := event.(type) {
+	case p2p.PeerAdded:
+		peer := event.Peer
+		found := fmt.Sprintf("found %s (%s) at %s:%d", peer.Name, peer.Id, peer.Ip, peer.Port)
+		if peer.DeviceType != "" {
+			found += fmt.Sprintf(", a %s", peer.DeviceType)
+			if peer.OS != "" {
+				found += fmt.Sprintf(" running %s", peer.OS)
+			}
+		}
+		return found
+	case p2p.PeerUpdated:
+		peer := event.Peer
+		return fmt.Sprintf("%s (%s) is now at %s:%d", peer.Name, peer.Id, peer.Ip, peer.Port)
+	case p2p.PeerRemoved:
+		return fmt.Sprintf("lost %s", p.name(event.PeerId))
+
+	case p2p.TransferRequested:
+		return fmt.Sprintf("%s wants to send %d files (%s)",
+			p.name(event.PeerId), len(event.Files), p2p.FormatBytes(float64(event.TotalSize)))
+	case p2p.RequestExpired:
+		return fmt.Sprintf("declined files from %s since nobody answered", p.name(event.PeerId))
+	case p2p.TransferProgress:
+		return describeProgress(event.Sending, event.Report)
+	case p2p.TransferCompleted:
+		return fmt.Sprintf("received %d files from %s", event.Files, event.SenderName)
+	case p2p.TransferDelivered:
+		return fmt.Sprintf("%s received the files", p.name(event.PeerId))
+	case p2p.TransferFailed:
+		return describeFailure(p.name(event.PeerId), event)
+
+	case p2p.PairingRequested:
+		return fmt.Sprintf("%s wants to pair, with code %s", p.name(event.PeerId), event.Code)
+	case p2p.Paired:
+		return fmt.Sprintf("paired with %s", p.name(event.PeerId))
+	case p2p.PairingFailed:
+		return fmt.Sprintf("couldn't pair with %s", p.name(event.PeerId))
+	case p2p.PeerImpersonated:
+		return fmt.Sprintf("%s isn't the device we paired with", p.name(event.PeerId))
+	case p2p.PeerLookAlike:
+		return fmt.Sprintf("another device is called %s, but it isn't the one we paired with",
+			p.name(event.PeerId))
+	case p2p.ShareExpired:
+		return "the share link expired"
+
+	case p2p.Error:
+		return fmt.Sprintf("error: %v", event)
+	}
+	return ""
+}
+
+func describeProgress(sending bool, report p2p.ProgressReport) string {
+	verb := "receiving"
+	if sending {
+		verb = "sending"
+	}
+	if report.Done {
+		return fmt.Sprintf("done %s", verb)
+	}
+	if report.Paused || report.PausedByPeer {
+		return "paused"
+	}
+
+	parts := []string{fmt.Sprintf("%s %3.0f%%", verb, report.Fraction()*100),
+		fmt.Sprintf("%s of %s",
+			p2p.FormatBytes(float64(report.BytesDone)), p2p.FormatBytes(float64(report.BytesTotal)))}
+	if report.Throughput > 0 {
+		parts = append(parts, fmt.Sprintf("%s/s", p2p.FormatBytes(report.Throughput)))
+	}
+	if report.ETA > 0 {
+		parts = append(parts, fmt.Sprintf("%s left", report.ETA.Round(time.Second)))
+	}
+	return strings.Join(parts, " · ")
+}
+
+func describeFailure(peer string, event p2p.TransferFailed) string {
+	switch {
+	case event.Corrupted:
+		return fmt.Sprintf("the files sent to %s were corrupted", peer)
+	case event.Cancelled:
+		return fmt.Sprintf("%s cancelled the transfer", peer)
+	case event.TimedOut:
+		return fmt.Sprintf("%s didn't answer in time", peer)
+	case event.Rejected && event.Reason == "":
+		return fmt.Sprintf("%s rejected the transfer", peer)
+	case event.Rejected:
+		return fmt.Sprintf("%s rejected the transfer: %s", peer, event.Reason)
+	}
+	return fmt.Sprintf("files from %s weren't received: %s", peer, event.Reason)
+}
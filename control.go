@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aabiji/drip/p2p"
+)
+
+// The control api lets scripts on this machine drive the running app, like
+// pushing build artifacts to test devices. It's off unless turned on in the
+// settings, only listens on localhost, and every request needs the token
+// written to control.json in the data folder, as "Authorization: Bearer <token>".
+//
+//	GET  /peers                   the devices we've found
+//	POST /peers                   {"Address": "host:port or pairing code"} to add one
+//	POST /send                    {"Peers": [ids or names], "Paths": [absolute paths]}
+//	GET  /requests                transfer requests waiting for an answer
+//	POST /requests/{id}/accept    optionally {"Files": [names]} to accept only some
+//	POST /requests/{id}/reject
+//	POST /transfers/{id}/cancel
+//	GET  /events                  every event from the node, one json object per line
+
+// What scripts read to find the api
+type controlInfo struct {
+	Url   string
+	Token string
+}
+
+type controlServer struct {
+	server   *http.Server
+	token    string
+	infoPath string
+	calls    chan<- func() // run by the app's event loop, so they can use its state
+
+	subscribers map[chan p2p.Event]bool
+	mu          sync.Mutex
+}
+
+// An error with the http status it should be sent with
+type controlError struct {
+	status  int
+	message string
+}
+
+func (e controlError) Error() string { return e.message }
+
+func badRequest(format string, args ...any) error {
+	return controlError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return controlError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func startControlServer(a *App, dataFolder string, port int) (*controlServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controlServer{
+		token:       hex.EncodeToString(secret),
+		infoPath:    filepath.Join(dataFolder, "control.json"),
+		calls:       a.controlCalls,
+		subscribers: make(map[chan p2p.Event]bool),
+	}
+	info, _ := json.Marshal(controlInfo{Url: "http://" + listener.Addr().String(), Token: c.token})
+	if err := os.MkdirAll(dataFolder, 0700); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.WriteFile(c.infoPath, info, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", c.call(a.controlPeers))
+	mux.HandleFunc("POST /peers", c.call(a.controlAddPeer))
+	mux.HandleFunc("POST /send", c.call(a.controlSend))
+	mux.HandleFunc("GET /requests", c.call(a.controlRequests))
+	mux.HandleFunc("POST /requests/{id}/accept", c.call(a.controlAccept))
+	mux.HandleFunc("POST /requests/{id}/reject", c.call(a.controlReject))
+	mux.HandleFunc("POST /transfers/{id}/cancel", c.call(a.controlCancel))
+	mux.HandleFunc("GET /events", c.streamEvents)
+	c.server = &http.Server{Handler: c.authorize(mux)}
+
+	go func() {
+		if err := c.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control api stopped: %v\n", err)
+		}
+	}()
+	return c, nil
+}
+
+func (c *controlServer) close() {
+	c.server.Close()
+	os.Remove(c.infoPath)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (c *controlServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, struct{ Error string }{"invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Run a handler on the app's event loop and send back what it returns.
+// The body's read beforehand so a slow client can't hold up the app.
+func (c *controlServer) call(
+	handler func(r *http.Request, body []byte) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+			return
+		}
+
+		type result struct {
+			value any
+			err   error
+		}
+		done := make(chan result, 1)
+		run := func() {
+			value, err := handler(r, body)
+			done <- result{value, err}
+		}
+		select {
+		case c.calls <- run:
+		case <-r.Context().Done():
+			return
+		}
+
+		res := <-done
+		var cerr controlError
+		switch {
+		case errors.As(res.err, &cerr):
+			writeJSON(w, cerr.status, struct{ Error string }{cerr.message})
+		case res.err != nil:
+			writeJSON(w, http.StatusInternalServerError, struct{ Error string }{res.err.Error()})
+		case res.value == nil:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusOK, res.value)
+		}
+	}
+}
+
+// Pass an event from the node along to everyone streaming events.
+// Clients that can't keep up are dropped rather than holding up the app.
+func (c *controlServer) publish(event p2p.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for subscriber := range c.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(c.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+func (c *controlServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	events := make(chan p2p.Event, 64)
+	c.mu.Lock()
+	c.subscribers[events] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.subscribers[events] {
+			delete(c.subscribers, events)
+			close(events)
+		}
+		c.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			err := encoder.Encode(struct {
+				Event string
+				Data  p2p.Event
+			}{reflect.TypeOf(event).Name(), event})
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// The handlers below run on the app's event loop
+
+func (a *App) controlPeers(r *http.Request, body []byte) (any, error) {
+	type peer struct{ Id, Name, DeviceType, OS string }
+	peers := []peer{}
+	for _, recipient := range a.ui.recipients {
+		peers = append(peers, peer{
+			recipient.id, recipient.name, recipient.peer.DeviceType, recipient.peer.OS})
+	}
+	return peers, nil
+}
+
+func (a *App) controlAddPeer(r *http.Request, body []byte) (any, error) {
+	var params struct{ Address string }
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, badRequest("invalid json: %v", err)
+	}
+	if err := a.addPeer(params.Address); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return nil, nil
+}
+
+// Find a peer by its id, or else its name
+func (a *App) findPeer(query string) (string, bool) {
+	for _, recipient := range a.ui.recipients {
+		if recipient.id == query {
+			return recipient.id, true
+		}
+	}
+	for _, recipient := range a.ui.recipients {
+		if strings.EqualFold(recipient.name, query) {
+			return recipient.id, true
+		}
+	}
+	return "", false
+}
+
+func (a *App) controlSend(r *http.Request, body []byte) (any, error) {
+	var params struct{ Peers, Paths []string }
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, badRequest("invalid json: %v", err)
+	}
+	if len(params.Peers) == 0 || len(params.Paths) == 0 {
+		return nil, badRequest("there has to be at least one peer and one path")
+	}
+
+	recipients := []string{}
+	for _, query := range params.Peers {
+		id, found := a.findPeer(query)
+		if !found {
+			return nil, notFound("couldn't find %s", query)
+		}
+		recipients = append(recipients, id)
+	}
+
+	policy := p2p.PRESERVE_SYMLINKS
+	if a.settings.FollowSymlinks.Value {
+		policy = p2p.FOLLOW_SYMLINKS
+	}
+	files := map[string]*p2p.File{}
+	opened := []*os.File{}
+	sending := false
+	defer func() {
+		if !sending { // a later path was bad, so nothing's going to read them
+			for _, file := range opened {
+				file.Close()
+			}
+		}
+	}()
+	for _, path := range params.Paths {
+		if !filepath.IsAbs(path) {
+			return nil, badRequest("%s isn't an absolute path", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, badRequest("%v", err)
+		}
+
+		if info.IsDir() {
+			entries, err := p2p.NewDirectoryFiles(path, policy)
+			if err != nil {
+				return nil, badRequest("couldn't read %s: %v", path, err)
+			}
+			for name := range entries {
+				if _, exists := files[name]; exists {
+					return nil, badRequest("more than one of the paths has %s in it", name)
+				}
+			}
+			maps.Copy(files, entries)
+			continue
+		}
+
+		name := filepath.Base(path)
+		if _, exists := files[name]; exists {
+			return nil, badRequest("more than one of the paths is named %s", name)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, badRequest("%v", err)
+		}
+		opened = append(opened, file)
+		files[name] = p2p.NewReaderFile(name, info.Size(), file)
+	}
+
+	sending = true
+	id := a.node.SendFiles(recipients, files)
+	return struct{ TransferId string }{id}, nil
+}
+
+func (a *App) controlRequests(r *http.Request, body []byte) (any, error) {
+	return slices.Clone(a.requests), nil
+}
+
+// Answer a request on the user's behalf, taking it off the popup
+func (a *App) answerRequest(id string, answer func()) error {
+	i := slices.IndexFunc(a.requests, func(r p2p.TransferRequested) bool {
+		return r.TransferId == id
+	})
+	if i == -1 {
+		return notFound("no request %s is waiting for an answer", id)
+	}
+	answer()
+	a.requests = slices.Delete(a.requests, i, i+1)
+	a.showNextRequest()
+	return nil
+}
+
+func (a *App) controlAccept(r *http.Request, body []byte) (any, error) {
+	id := r.PathValue("id")
+	var params struct{ Files []string }
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			return nil, badRequest("invalid json: %v", err)
+		}
+	}
+	return nil, a.answerRequest(id, func() {
+		if params.Files != nil {
+			a.node.AcceptFiles(id, params.Files)
+		} else {
+			a.node.RespondToRequest(id, true)
+		}
+	})
+}
+
+func (a *App) controlReject(r *http.Request, body []byte) (any, error) {
+	id := r.PathValue("id")
+	return nil, a.answerRequest(id, func() { a.node.RespondToRequest(id, false) })
+}
+
+func (a *App) controlCancel(r *http.Request, body []byte) (any, error) {
+	id := r.PathValue("id")
+	if !a.node.HasTransfer(id) {
+		return nil, notFound("no transfer %s", id)
+	}
+	a.node.CancelTransfer(id)
+	if id == a.currentTransfer {
+		a.currentTransfer = ""
+		a.ui.ForgetCurrentTransfer(false, false)
+	}
+	a.ui.ForgetIncoming(id)
+	return nil, nil
+}
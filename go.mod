@@ -8,6 +8,7 @@ require (
 	github.com/aabiji/drip/p2p v0.0.0-00010101000000-000000000000
 	github.com/timob/jnigi v0.0.0-20240411031203-21c53b5cc54a
 	golang.org/x/exp/shiny v0.0.0-20250718183923-645b1fa84792
+	rsc.io/qr v0.2.0
 )
 
 replace github.com/aabiji/drip/p2p => ./p2p
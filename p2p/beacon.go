@@ -0,0 +1,243 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Some networks drop mDNS, so we also announce ourselves with a small
+// udp beacon. The same beacon is used to answer probes from devices
+// that were told our address directly.
+const (
+	beaconGroup     = "239.255.42.42:42424"
+	beaconFrequency = time.Second * 5
+	maxBeaconSize   = 1024
+)
+
+type beacon struct {
+	Id    string
+	Name  string
+	Port  int
+	Probe bool `json:",omitempty"` // asking the receiver to send its own beacon back
+
+	// like the mDNS TXT record, missing from older devices
+	Version      int      `json:",omitempty"`
+	Type         string   `json:",omitempty"`
+	OS           string   `json:",omitempty"`
+	Capabilities []string `json:",omitempty"`
+}
+
+// What both udp backends have in common
+type beaconFields struct {
+	devicePort  int
+	displayName string
+	peers       peerTable
+	mu          sync.Mutex
+}
+
+func (f *beaconFields) beacon(probe bool) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var us PeerInfo
+	us.describeUs()
+	data, err := json.Marshal(beacon{
+		Id: deviceId(), Name: f.displayName, Port: f.devicePort, Probe: probe,
+		Version: us.Version, Type: us.DeviceType, OS: us.OS, Capabilities: us.Capabilities})
+	if err != nil {
+		panic(err) // a beacon's fields can always be encoded
+	}
+	return data
+}
+
+func (f *beaconFields) SetDisplayName(name string) error {
+	f.mu.Lock()
+	f.displayName = name
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *beaconFields) Forget(peerId string) { f.peers.forget(peerId) }
+
+// Parse a beacon, returning whether it came from another device
+func parseBeacon(data []byte) (beacon, bool) {
+	var b beacon
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, false
+	}
+	valid := b.Id != "" && b.Id != deviceId() && b.Port > 0 && b.Port <= 65535
+	return b, valid
+}
+
+func (f *beaconFields) heardFrom(b beacon, addr *net.UDPAddr, events chan Message) {
+	name := b.Name
+	if name == "" {
+		name = b.Id
+	}
+	info := PeerInfo{Ip: addr.IP.To4(), Id: b.Id, Name: name, Port: b.Port}
+	info.describe(b.Version, b.Type, b.OS, b.Capabilities)
+	f.peers.heardFrom(info, events)
+}
+
+// Read packets until the connection is closed
+func readBeacons(conn *net.UDPConn, handle func(beacon, *net.UDPAddr)) error {
+	buffer := make([]byte, maxBeaconSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if b, valid := parseBeacon(buffer[:n]); valid {
+			handle(b, addr)
+		}
+	}
+}
+
+// Finds peers by sending beacons to a multicast group
+type BeaconDiscovery struct {
+	beaconFields
+}
+
+func NewBeaconDiscovery(devicePort int, displayName string) *BeaconDiscovery {
+	return &BeaconDiscovery{beaconFields{
+		devicePort: devicePort, displayName: displayName, peers: newPeerTable(time.Now)}}
+}
+
+func (d *BeaconDiscovery) Run(ctx context.Context, events chan Message) error {
+	group, err := net.ResolveUDPAddr("udp4", beaconGroup)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	sender, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	defer sender.Close()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(beaconFrequency)
+		defer ticker.Stop()
+		for {
+			if _, err := sender.Write(d.beacon(false)); err != nil {
+				log.Printf("Failed to send a discovery beacon: %v\n", err)
+			}
+			d.peers.expire(beaconFrequency*3, events)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return readBeacons(listener, func(b beacon, addr *net.UDPAddr) {
+		d.heardFrom(b, addr, events)
+	})
+}
+
+// Finds peers at addresses the user gave us by probing them directly.
+// It also answers probes from other devices, and adds them since they
+// know about us, so it should always run.
+type StaticDiscovery struct {
+	beaconFields
+	addresses []string    // host:port, guarded by mu
+	added     chan string // addresses to probe right away
+}
+
+func NewStaticDiscovery(devicePort int, displayName string, addresses []string) *StaticDiscovery {
+	return &StaticDiscovery{
+		beaconFields: beaconFields{
+			devicePort: devicePort, displayName: displayName, peers: newPeerTable(time.Now)},
+		addresses: slices.Clone(addresses),
+		added:     make(chan string, 10),
+	}
+}
+
+// Start looking for a device at another address
+func (d *StaticDiscovery) Add(address string) {
+	d.mu.Lock()
+	exists := slices.Contains(d.addresses, address)
+	if !exists {
+		d.addresses = append(d.addresses, address)
+	}
+	d.mu.Unlock()
+	if !exists {
+		select {
+		case d.added <- address:
+		default: // it'll be probed on the next tick anyway
+		}
+	}
+}
+
+func (d *StaticDiscovery) probe(conn *net.UDPConn, address string) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		log.Printf("Failed to resolve %s: %v\n", address, err)
+		return
+	}
+	conn.WriteToUDP(d.beacon(true), addr)
+}
+
+func (d *StaticDiscovery) Run(ctx context.Context, events chan Message) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: d.devicePort})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(beaconFrequency)
+		defer ticker.Stop()
+		probeAll := func() {
+			d.mu.Lock()
+			addresses := slices.Clone(d.addresses)
+			d.mu.Unlock()
+			for _, address := range addresses {
+				d.probe(conn, address)
+			}
+			d.peers.expire(beaconFrequency*3, events)
+		}
+
+		probeAll()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case address := <-d.added:
+				d.probe(conn, address)
+			case <-ticker.C:
+				probeAll()
+			}
+		}
+	}()
+
+	return readBeacons(conn, func(b beacon, addr *net.UDPAddr) {
+		if b.Probe {
+			conn.WriteToUDP(d.beacon(false), addr)
+		}
+		// a device probing us keeps doing so, which keeps it from expiring
+		d.heardFrom(b, addr, events)
+	})
+}
@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Chunks are sent on their own data channel in a compact binary frame
+// instead of json, since base64 encoding the data is too expensive:
+//
+//	version     1 byte
+//	transfer id 16 bytes (uuid)
+//	file index  4 bytes
+//	offset      8 bytes
+//	length      4 bytes
+//	data        length bytes
+const (
+	chunkFrameVersion = 1
+	chunkHeaderSize   = 1 + 16 + 4 + 8 + 4
+)
+
+var errMalformedChunk = errors.New("malformed chunk frame")
+
+type Chunk struct {
+	TransferId string
+	FileIndex  uint32
+	Offset     int64
+	Data       []byte
+}
+
+func (c Chunk) MarshalBinary() ([]byte, error) {
+	id, err := uuid.Parse(c.TransferId)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, chunkHeaderSize+len(c.Data))
+	frame[0] = chunkFrameVersion
+	copy(frame[1:17], id[:])
+	binary.BigEndian.PutUint32(frame[17:21], c.FileIndex)
+	binary.BigEndian.PutUint64(frame[21:29], uint64(c.Offset))
+	binary.BigEndian.PutUint32(frame[29:33], uint32(len(c.Data)))
+	copy(frame[chunkHeaderSize:], c.Data)
+	return frame, nil
+}
+
+// The chunk's data refers to the frame, it isn't copied
+func (c *Chunk) UnmarshalBinary(frame []byte) error {
+	if len(frame) < chunkHeaderSize || frame[0] != chunkFrameVersion {
+		return errMalformedChunk
+	}
+
+	length := binary.BigEndian.Uint32(frame[29:33])
+	if int(length) != len(frame)-chunkHeaderSize {
+		return errMalformedChunk
+	}
+
+	id, err := uuid.FromBytes(frame[1:17])
+	if err != nil {
+		return err
+	}
+
+	c.TransferId = id.String()
+	c.FileIndex = binary.BigEndian.Uint32(frame[17:21])
+	c.Offset = int64(binary.BigEndian.Uint64(frame[21:29]))
+	c.Data = frame[chunkHeaderSize:]
+	return nil
+}
+
+func NewChunkMessage(chunk Chunk) (Message, error) {
+	frame, err := chunk.MarshalBinary()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: TRANSFER_CHUNK, Data: frame, Sender: deviceId()}, nil
+}
+
+func GetChunk(msg Message) (Chunk, error) {
+	var chunk Chunk
+	err := chunk.UnmarshalBinary(msg.Data)
+	return chunk, err
+}
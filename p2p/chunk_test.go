@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testChunk() Chunk {
+	return Chunk{
+		TransferId: uuid.NewString(),
+		FileIndex:  3,
+		Offset:     5 * chunkSize,
+		Data:       bytes.Repeat([]byte{0xd1}, chunkSize),
+	}
+}
+
+func TestChunkFrameRoundTrip(t *testing.T) {
+	chunk := testChunk()
+	msg, err := NewChunkMessage(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetChunk(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TransferId != chunk.TransferId || got.FileIndex != chunk.FileIndex ||
+		got.Offset != chunk.Offset || !bytes.Equal(got.Data, chunk.Data) {
+		t.Fatal("the chunk changed on the way through")
+	}
+
+	msg.Data = msg.Data[:len(msg.Data)-1]
+	if _, err := GetChunk(msg); err == nil {
+		t.Fatal("accepted a truncated frame")
+	}
+}
+
+// How chunks were sent before they had their own frame,
+// as json with the data base64 encoded
+func BenchmarkChunkJSON(b *testing.B) {
+	chunk := testChunk()
+	b.SetBytes(int64(len(chunk.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		msg := NewMessage(TRANSFER_CHUNK, chunk)
+		if _, err := Deserialize[Chunk](msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkFrame(b *testing.B) {
+	chunk := testChunk()
+	b.SetBytes(int64(len(chunk.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		msg, err := NewChunkMessage(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := GetChunk(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package p2p
+
+import "time"
+
+// There's no getrusage here, so there's no cpu time to report
+func cpuTime() time.Duration { return 0 }
@@ -0,0 +1,17 @@
+//go:build unix
+
+package p2p
+
+import (
+	"syscall"
+	"time"
+)
+
+// How much cpu time the process has used so far, in user and kernel mode
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// What devices advertise about themselves when they're discovered, so
+// they can be shown properly and so newer devices can avoid what older
+// ones don't understand.
+
+// The version of the protocol we speak. It's bumped when
+// a change would confuse devices running an older version.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1 // the oldest version we still talk to, devices without one are older
+)
+
+const ( // device types
+	DESKTOP_DEVICE = "desktop"
+	PHONE_DEVICE   = "phone"
+	SERVER_DEVICE  = "server"
+)
+
+const ( // capabilities
+	PAIRING_CAPABILITY = "pairing"
+	RESUME_CAPABILITY  = "resume"  // pausing and resuming transfers
+	SELECT_CAPABILITY  = "select"  // accepting only some of the files
+	PREVIEW_CAPABILITY = "preview" // thumbnails in transfer requests
+)
+
+var ourCapabilities = []string{
+	PAIRING_CAPABILITY, RESUME_CAPABILITY, SELECT_CAPABILITY, PREVIEW_CAPABILITY}
+
+// Set once the node starts, like the device id
+var localDeviceType = defaultDeviceType()
+
+func defaultDeviceType() string {
+	if runtime.GOOS == "android" || runtime.GOOS == "ios" {
+		return PHONE_DEVICE
+	}
+	return DESKTOP_DEVICE
+}
+
+func (p PeerInfo) Supports(capability string) bool {
+	return slices.Contains(p.Capabilities, capability)
+}
+
+// Whether we can talk to the device at all
+func (p PeerInfo) Compatible() bool {
+	return p.Version >= minProtocolVersion
+}
+
+// Fill in what we advertise about ourselves
+func (p *PeerInfo) describeUs() {
+	p.Version = protocolVersion
+	p.DeviceType = localDeviceType
+	p.OS = runtime.GOOS
+	p.Capabilities = ourCapabilities
+}
+
+// Fill in what a device advertised. Devices that don't give a version
+// predate versions, so they can't do anything version 1 added, like
+// binary chunk frames, identities or pairing, whatever they claim.
+func (p *PeerInfo) describe(version int, deviceType string, os string, capabilities []string) {
+	p.Version = max(version, 0)
+	p.DeviceType = deviceType
+	p.OS = os
+	p.Capabilities = capabilities
+	if version <= 0 {
+		p.Capabilities = nil
+	}
+}
+
+// The mDNS TXT record describing us
+func txtRecord(name string) []string {
+	var us PeerInfo
+	us.describeUs()
+	return []string{
+		"v=" + strconv.Itoa(us.Version),
+		"id=" + deviceId(),
+		"name=" + name,
+		"type=" + us.DeviceType,
+		"os=" + us.OS,
+		"caps=" + strings.Join(us.Capabilities, ","),
+	}
+}
+
+// Read a TXT record into a peer's info. The id and name are left alone if it doesn't have them.
+func parseTXTRecord(fields []string, info *PeerInfo) {
+	values := make(map[string]string)
+	for _, field := range fields {
+		if key, value, found := strings.Cut(field, "="); found {
+			values[key] = value
+		}
+	}
+
+	version, _ := strconv.Atoi(values["v"])
+	capabilities := []string{}
+	for _, capability := range strings.Split(values["caps"], ",") {
+		if capability != "" {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	info.describe(version, values["type"], values["os"], capabilities)
+
+	if values["id"] != "" {
+		info.Id = values["id"]
+	}
+	if values["name"] != "" {
+		info.Name = values["name"]
+	}
+}
@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDescribingPeers(t *testing.T) {
+	tests := map[string]struct {
+		record       []string
+		compatible   bool
+		capabilities []string
+	}{
+		"current": {
+			record:       []string{"v=1", "caps=pairing,resume"},
+			compatible:   true,
+			capabilities: []string{PAIRING_CAPABILITY, RESUME_CAPABILITY},
+		},
+		"newer": {
+			record:       []string{"v=7", "caps=pairing,teleport"},
+			compatible:   true,
+			capabilities: []string{PAIRING_CAPABILITY, "teleport"},
+		},
+		"no version":      {record: []string{"caps=pairing"}},
+		"invalid version": {record: []string{"v=two", "caps=pairing"}},
+		"negative":        {record: []string{"v=-1"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var info PeerInfo
+			parseTXTRecord(test.record, &info)
+			if info.Compatible() != test.compatible {
+				t.Errorf("compatible is %v", info.Compatible())
+			}
+			if !slices.Equal(info.Capabilities, test.capabilities) {
+				t.Errorf("capabilities are %v instead of %v", info.Capabilities, test.capabilities)
+			}
+		})
+	}
+}
+
+func TestOurRecordDescribesUs(t *testing.T) {
+	var info PeerInfo
+	parseTXTRecord(txtRecord("laptop"), &info)
+	if info.Name != "laptop" || !info.Compatible() ||
+		!slices.Equal(info.Capabilities, ourCapabilities) {
+		t.Fatalf("we'd be seen as %+v", info)
+	}
+}
@@ -0,0 +1,286 @@
+package p2p
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const ( // kinds of entries in a transfer
+	REGULAR_FILE = iota
+	DIRECTORY
+	SYMLINK
+)
+
+// how many numbered names to try before giving up on saving a file
+const maxRenames = 1000
+
+// What to do with the symlinks found in a directory being sent
+type SymlinkPolicy int
+
+const (
+	SKIP_SYMLINKS     SymlinkPolicy = iota
+	FOLLOW_SYMLINKS                 // send the file the link points to
+	PRESERVE_SYMLINKS               // recreate the link on the receiver
+)
+
+// Collect everything in a directory, keyed by its path relative
+// to the directory's parent so that the tree can be recreated
+func NewDirectoryFiles(root string, policy SymlinkPolicy) (map[string]*File, error) {
+	root = filepath.Clean(root)
+	base := filepath.Dir(root)
+	files := make(map[string]*File)
+
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relative)
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+
+		file := NewReaderFile(name, 0, nil)
+		file.Mode = info.Mode().Perm()
+		file.ModTime = info.ModTime()
+
+		switch {
+		case info.IsDir():
+			file.Kind = DIRECTORY
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			if policy == SKIP_SYMLINKS {
+				return nil
+			}
+
+			if policy == PRESERVE_SYMLINKS {
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				file.Kind = SYMLINK
+				file.LinkTarget = filepath.ToSlash(target)
+				break
+			}
+
+			// following links to directories could loop forever
+			target, err := os.Stat(p)
+			if err != nil || !target.Mode().IsRegular() {
+				return nil
+			}
+			file.Kind = REGULAR_FILE
+			file.Size = target.Size()
+			file.Mode = target.Mode().Perm()
+			file.ModTime = target.ModTime()
+			file.sourcePath = p
+
+		case info.Mode().IsRegular():
+			file.Kind = REGULAR_FILE
+			file.Size = info.Size()
+			file.sourcePath = p
+
+		default:
+			return nil // sockets, devices, etc. can't be sent
+		}
+
+		files[name] = file
+		return nil
+	})
+	return files, err
+}
+
+// Create a received entry on disk. Regular files are only
+// mapped once their first chunk arrives.
+func createEntry(f *File, downloadFolder string) error {
+	relative, err := filepath.Rel(downloadFolder, f.Name)
+	if err != nil || !staysWithin(downloadFolder, relative) {
+		return fmt.Errorf("%s would end up outside the download folder", filepath.Base(f.Name))
+	}
+
+	switch f.Kind {
+	case DIRECTORY:
+		f.doneReceiving = true
+		if info, err := os.Lstat(f.Name); err == nil && info.IsDir() {
+			return nil // the files go in alongside what's already there
+		}
+		if err := os.MkdirAll(f.Name, 0755); err != nil {
+			return err
+		}
+		f.created = true
+		return nil
+
+	case SYMLINK:
+		f.doneReceiving = true // created once everything else is in place
+		return os.MkdirAll(filepath.Dir(f.Name), 0755)
+
+	default:
+		if err := os.MkdirAll(filepath.Dir(f.Name), 0755); err != nil {
+			return err
+		}
+		file, name, err := createUnique(f.Name)
+		if err != nil {
+			return err
+		}
+		f.Name, f.created = name, true
+		f.doneReceiving = f.Size == 0 // empty files can't be mapped
+		return file.Close()
+	}
+}
+
+// Create a file that doesn't exist yet, so a transfer never writes over
+// something that was already there. Taken names get a number, like "notes (1).txt".
+func createUnique(name string) (*os.File, string, error) {
+	folder, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = "" // dotfiles like .bashrc
+	}
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := range maxRenames {
+		candidate := name
+		if i > 0 {
+			candidate = filepath.Join(folder, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		}
+		file, err := os.OpenFile(candidate, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			return file, candidate, err
+		}
+	}
+	return nil, "", fmt.Errorf("there are too many files named like %s already", base)
+}
+
+// Only links that stay inside the download folder are recreated
+func linkIsContained(f *File, downloadFolder string) bool {
+	if path.IsAbs(f.LinkTarget) || filepath.IsAbs(f.LinkTarget) {
+		return false
+	}
+	folder, err := filepath.Rel(downloadFolder, filepath.Dir(f.Name))
+	if err != nil {
+		return false
+	}
+	// not joined, which would clean away the ".." that follow a link
+	return staysWithin(downloadFolder, filepath.ToSlash(folder)+"/"+f.LinkTarget)
+}
+
+// Follow a relative path from a folder the way the filesystem would, checking
+// that it never leaves the folder. Links that are already there are followed,
+// so that a chain of them can't climb out. A ".." after a part that doesn't
+// exist yet is refused, since that part could turn out to be a link.
+func staysWithin(folder string, relative string) bool {
+	root, err := filepath.EvalSymlinks(folder)
+	if err != nil {
+		return false
+	}
+
+	current, missing := root, false
+	for _, part := range strings.Split(filepath.ToSlash(relative), "/") {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == "..":
+			if missing {
+				return false
+			}
+			current = filepath.Dir(current)
+		case missing:
+			current = filepath.Join(current, part)
+		default:
+			next := filepath.Join(current, part)
+			info, err := os.Lstat(next)
+			if errors.Is(err, os.ErrNotExist) {
+				missing, current = true, next
+			} else if err != nil {
+				return false
+			} else if info.Mode()&fs.ModeSymlink != 0 {
+				if current, err = filepath.EvalSymlinks(next); err != nil {
+					return false // it leads nowhere, so there's no telling where it will
+				}
+			} else {
+				current = next
+			}
+		}
+
+		inside, err := filepath.Rel(root, current)
+		if err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Recreate the symlinks, permissions and modification times of a
+// completed transfer. Directories go last, deepest first, since
+// writing their contents would change their modification times.
+func applyMetadata(t *Transfer, downloadFolder string) {
+	entries := slices.Collect(maps.Values(t.Files))
+	slices.SortFunc(entries, func(a, b *File) int {
+		if (a.Kind == DIRECTORY) != (b.Kind == DIRECTORY) {
+			if a.Kind == DIRECTORY {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(strings.Count(b.Name, "/"), strings.Count(a.Name, "/"))
+	})
+
+	for _, f := range entries {
+		if f.Kind == SYMLINK {
+			if !linkIsContained(f, downloadFolder) {
+				log.Printf("Not creating %s, it points outside the download folder\n", f.Name)
+				continue
+			}
+			err := os.Symlink(filepath.FromSlash(f.LinkTarget), f.Name)
+			if err != nil && !errors.Is(err, os.ErrExist) {
+				log.Printf("Failed to create the symlink %s: %v\n", f.Name, err)
+			}
+			continue
+		}
+
+		if f.Mode != 0 {
+			if err := os.Chmod(f.Name, f.Mode); err != nil {
+				log.Printf("Failed to set the permissions of %s: %v\n", f.Name, err)
+			}
+		}
+		if !f.ModTime.IsZero() {
+			if err := os.Chtimes(f.Name, f.ModTime, f.ModTime); err != nil {
+				log.Printf("Failed to set the modification time of %s: %v\n", f.Name, err)
+			}
+		}
+	}
+}
+
+// Remove what was received of a transfer, files before the directories
+// holding them. Only what the transfer created is removed.
+func removeEntries(t *Transfer) {
+	entries := slices.Collect(maps.Values(t.Files))
+	slices.SortFunc(entries, func(a, b *File) int {
+		return cmp.Compare(len(b.Name), len(a.Name))
+	})
+
+	for _, f := range entries {
+		f.CloseWriter()
+		if !f.created {
+			continue // it was already there, or it's a symlink, which is created last
+		}
+		err := os.Remove(f.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) && f.Kind != DIRECTORY {
+			log.Printf("Failed to remove %s: %v\n", f.Name, err)
+		}
+	}
+}
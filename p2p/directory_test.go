@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReceivingKeepsExistingFiles(t *testing.T) {
+	folder := t.TempDir()
+	for _, name := range []string{"notes.txt", "empty", ".bashrc"} {
+		if err := os.WriteFile(filepath.Join(folder, name), []byte("mine"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transfer := &Transfer{Files: map[string]*File{
+		"notes.txt": {Name: filepath.Join(folder, "notes.txt"), Size: 10, Kind: REGULAR_FILE},
+		"empty":     {Name: filepath.Join(folder, "empty"), Kind: REGULAR_FILE},
+		".bashrc":   {Name: filepath.Join(folder, ".bashrc"), Size: 10, Kind: REGULAR_FILE},
+	}}
+	renamed := map[string]string{
+		"notes.txt": "notes (1).txt", "empty": "empty (1)", ".bashrc": ".bashrc (1)"}
+	for name, f := range transfer.Files {
+		if err := createEntry(f, folder); err != nil {
+			t.Fatal(err)
+		}
+		if f.Name != filepath.Join(folder, renamed[name]) {
+			t.Errorf("%s was saved as %s instead of %s", name, f.Name, renamed[name])
+		}
+	}
+
+	removeEntries(transfer)
+	for name, f := range transfer.Files {
+		contents, err := os.ReadFile(filepath.Join(folder, name))
+		if err != nil || string(contents) != "mine" {
+			t.Errorf("%s was changed: %q, %v", name, contents, err)
+		}
+		if _, err := os.Stat(f.Name); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", f.Name)
+		}
+	}
+}
+
+func TestRemovingKeepsExistingFolders(t *testing.T) {
+	folder := t.TempDir()
+	existing := filepath.Join(folder, "photos")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := &Transfer{Files: map[string]*File{
+		"photos":       {Name: existing, Kind: DIRECTORY},
+		"photos/new":   {Name: filepath.Join(existing, "new"), Kind: DIRECTORY},
+		"photos/a.jpg": {Name: filepath.Join(existing, "a.jpg"), Size: 10, Kind: REGULAR_FILE},
+	}}
+	for _, f := range transfer.Files {
+		if err := createEntry(f, folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeEntries(transfer)
+
+	if _, err := os.Stat(existing); err != nil {
+		t.Fatal("the folder that was already there was removed")
+	}
+	entries, _ := os.ReadDir(existing)
+	if len(entries) != 0 {
+		t.Fatalf("%d received entries were left behind", len(entries))
+	}
+}
+
+func TestWriterCoversTheWholeFile(t *testing.T) {
+	folder := t.TempDir()
+	f := &File{Name: filepath.Join(folder, "a"), Size: 1000, Kind: REGULAR_FILE}
+	if err := createEntry(f, folder); err != nil {
+		t.Fatal(err)
+	}
+	// like a partial file from an earlier session that's shorter than it should be
+	if err := os.WriteFile(f.Name, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.openWriter(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.CloseWriter()
+	if len(f.writer) != int(f.Size) || string(f.writer[:7]) != "partial" {
+		t.Fatalf("mapped %d bytes starting with %q", len(f.writer), f.writer[:7])
+	}
+}
+
+func TestLinksStayInTheDownloadFolder(t *testing.T) {
+	folder, outside := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(folder, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"d/up":     "..",                                   // back to the download folder
+		"out":      outside,                                // somewhere else entirely
+		"dangling": filepath.Join(outside, "nothing/here"), // somewhere that doesn't exist yet
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(folder, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]bool{
+		"b":            true,
+		"../d/b":       true,
+		"up/b":         true,
+		"up/d/up/d/b":  true,
+		"../..":        false,
+		"/etc/passwd":  false,
+		"up/../secret": false, // fine if up weren't a link
+		"up/out/b":     false,
+		"../out/b":     false,
+		"../dangling":  false,
+		"new/../../b":  false, // new could be a link by the time this one is followed
+	}
+	for target, contained := range tests {
+		link := &File{Name: filepath.Join(folder, "d", "link"), Kind: SYMLINK, LinkTarget: target}
+		if linkIsContained(link, folder) != contained {
+			t.Errorf("%s: contained should be %v", target, contained)
+		}
+	}
+}
+
+func TestEntriesCantBeCreatedThroughLinks(t *testing.T) {
+	folder, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(folder, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []*File{
+		{Name: filepath.Join(folder, "out", "a.txt"), Size: 10, Kind: REGULAR_FILE},
+		{Name: filepath.Join(folder, "out", "empty"), Kind: REGULAR_FILE},
+		{Name: filepath.Join(folder, "out", "sub"), Kind: DIRECTORY},
+		{Name: filepath.Join(folder, "out", "sub", "link"), Kind: SYMLINK, LinkTarget: "a"},
+	}
+	for _, f := range entries {
+		if err := createEntry(f, folder); err == nil {
+			t.Errorf("created %s through a link", f.Name)
+		}
+	}
+	if created, _ := os.ReadDir(outside); len(created) != 0 {
+		t.Fatalf("%d entries were created outside the download folder", len(created))
+	}
+}
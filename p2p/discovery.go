@@ -0,0 +1,194 @@
+package p2p
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Finds other devices on the network
+type Discovery interface {
+	// Look for peers until the context is cancelled, sending an ADDED_PEER
+	// event with a PeerInfo when one is found, an UPDATED_PEER event when its
+	// address or name changes, and a LOST_PEER event with its id when we
+	// stop hearing from it
+	Run(ctx context.Context, events chan Message) error
+
+	// Advertise ourselves under a new name
+	SetDisplayName(name string) error
+
+	// Forget about a peer whose connection was closed so
+	// that it gets added again the next time we hear from it
+	Forget(peerId string)
+}
+
+type DiscoveryConfig struct {
+	NoMDNS      bool
+	NoBeacon    bool
+	StaticPeers []string // host:port addresses of devices to look for directly
+}
+
+// Runs several discovery backends at once. A peer found by more than one
+// backend is only added once, and is only lost once none of them see it.
+type multiDiscovery struct {
+	backends []Discovery
+	seen     map[string]map[int]bool // peer id -> backends that see it
+	mu       sync.Mutex
+}
+
+func NewDiscovery(backends ...Discovery) Discovery {
+	return &multiDiscovery{backends: backends, seen: make(map[string]map[int]bool)}
+}
+
+func (d *multiDiscovery) Run(ctx context.Context, events chan Message) error {
+	var wg sync.WaitGroup
+	for i, backend := range d.backends {
+		backendEvents := make(chan Message, 25)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// one backend not working shouldn't stop the others
+			if err := backend.Run(ctx, backendEvents); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to run peer discovery: %v\n", err)
+			}
+		}()
+
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-backendEvents:
+					if forward, ok := d.merge(i, event); ok {
+						events <- forward
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// Decide whether an event from a backend should be passed along
+func (d *multiDiscovery) merge(backend int, event Message) (Message, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch event.Type {
+	case ADDED_PEER:
+		info, err := Deserialize[PeerInfo](event)
+		if err != nil {
+			return event, false
+		}
+		seenBy, exists := d.seen[info.Id]
+		if !exists {
+			seenBy = make(map[int]bool)
+			d.seen[info.Id] = seenBy
+		}
+		seenBy[backend] = true
+		return event, !exists
+
+	case UPDATED_PEER:
+		info, err := Deserialize[PeerInfo](event)
+		if err != nil {
+			return event, false
+		}
+		_, exists := d.seen[info.Id]
+		return event, exists
+
+	case LOST_PEER:
+		peerId, err := Deserialize[string](event)
+		if err != nil {
+			return event, false
+		}
+		seenBy, exists := d.seen[peerId]
+		if !exists {
+			return event, false
+		}
+		delete(seenBy, backend)
+		if len(seenBy) > 0 {
+			return event, false
+		}
+		delete(d.seen, peerId)
+		return event, true
+	}
+	return event, false
+}
+
+func (d *multiDiscovery) SetDisplayName(name string) error {
+	for _, backend := range d.backends {
+		if err := backend.SetDisplayName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *multiDiscovery) Forget(peerId string) {
+	d.mu.Lock()
+	delete(d.seen, peerId)
+	d.mu.Unlock()
+	for _, backend := range d.backends {
+		backend.Forget(peerId)
+	}
+}
+
+// Keeps track of when we last heard from each peer. A peer appears the
+// first time we hear from it, is updated when its address or name changes,
+// and expires when we haven't heard from it in a while.
+type peerTable struct {
+	peers map[string]PeerInfo
+	now   func() time.Time // swapped out to control time
+	mu    sync.Mutex
+}
+
+func newPeerTable(now func() time.Time) peerTable {
+	return peerTable{peers: make(map[string]PeerInfo), now: now}
+}
+
+// Record that we heard from a peer, sending ADDED_PEER if it's new or
+// UPDATED_PEER if it's now somewhere else, has a new name or was updated
+func (t *peerTable) heardFrom(info PeerInfo, events chan Message) {
+	t.mu.Lock()
+	previous, exists := t.peers[info.Id]
+	info.LastHeardFrom = t.now()
+	t.peers[info.Id] = info
+	t.mu.Unlock()
+
+	if !exists {
+		events <- NewMessage(ADDED_PEER, info)
+	} else if !previous.Ip.Equal(info.Ip) ||
+		previous.Port != info.Port || previous.Name != info.Name ||
+		previous.Version != info.Version || previous.DeviceType != info.DeviceType ||
+		!slices.Equal(previous.Capabilities, info.Capabilities) {
+		events <- NewMessage(UPDATED_PEER, info)
+	}
+}
+
+// Remove the peers we haven't heard from in a while, sending LOST_PEER for each
+func (t *peerTable) expire(limit time.Duration, events chan Message) {
+	t.mu.Lock()
+	expired := []string{}
+	for id, peer := range t.peers {
+		if t.now().Sub(peer.LastHeardFrom) >= limit {
+			delete(t.peers, id)
+			expired = append(expired, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, id := range expired {
+		events <- NewMessage(LOST_PEER, id)
+	}
+}
+
+func (t *peerTable) forget(peerId string) {
+	t.mu.Lock()
+	delete(t.peers, peerId)
+	t.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when it's told to
+type fakeClock struct{ current time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.current }
+func (c *fakeClock) advance(d time.Duration) { c.current = c.current.Add(d) }
+
+func TestPeerTable(t *testing.T) {
+	const limit = 10 * time.Second
+	peer := PeerInfo{Id: "peer", Name: "laptop", Ip: net.IPv4(192, 168, 1, 5), Port: 8000}
+	moved := peer
+	moved.Ip = net.IPv4(192, 168, 1, 6)
+	renamed := peer
+	renamed.Name = "work laptop"
+	upgraded := peer
+	upgraded.Capabilities = []string{"pairing"}
+
+	// what happens after hearing from a peer, then waiting a while
+	type step struct {
+		wait  time.Duration
+		heard *PeerInfo // nothing if nil, the table just expires old peers
+		want  []int     // the messages that come out
+	}
+	tests := map[string][]step{
+		"new peer":                {{heard: &peer, want: []int{ADDED_PEER}}},
+		"nothing changed":         {{heard: &peer, want: []int{ADDED_PEER}}, {wait: time.Second, heard: &peer}},
+		"moved":                   {{heard: &peer, want: []int{ADDED_PEER}}, {heard: &moved, want: []int{UPDATED_PEER}}},
+		"renamed":                 {{heard: &peer, want: []int{ADDED_PEER}}, {heard: &renamed, want: []int{UPDATED_PEER}}},
+		"new capabilities":        {{heard: &peer, want: []int{ADDED_PEER}}, {heard: &upgraded, want: []int{UPDATED_PEER}}},
+		"not expired yet":         {{heard: &peer, want: []int{ADDED_PEER}}, {wait: limit - time.Second}},
+		"expired":                 {{heard: &peer, want: []int{ADDED_PEER}}, {wait: limit, want: []int{LOST_PEER}}},
+		"hearing again delays it": {{heard: &peer, want: []int{ADDED_PEER}}, {wait: limit - time.Second, heard: &peer}, {wait: limit - time.Second}},
+		"back after expiring": {
+			{heard: &peer, want: []int{ADDED_PEER}},
+			{wait: limit, want: []int{LOST_PEER}},
+			{heard: &peer, want: []int{ADDED_PEER}},
+		},
+	}
+
+	for name, steps := range tests {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{current: time.Unix(1000, 0)}
+			table := newPeerTable(clock.now)
+			for i, s := range steps {
+				events := make(chan Message, 8)
+				clock.advance(s.wait)
+				if s.heard != nil {
+					table.heardFrom(*s.heard, events)
+				} else {
+					table.expire(limit, events)
+				}
+				close(events)
+
+				var got []int
+				for msg := range events {
+					got = append(got, msg.Type)
+				}
+				if !slices.Equal(got, s.want) {
+					t.Fatalf("step %d: got messages %v instead of %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package p2p
+
+import "fmt"
+
+const ( // error kinds
+	NETWORK_ERROR  = iota
+	PROTOCOL_ERROR // a peer sent something we couldn't make sense of
+	STORAGE_ERROR  // reading or writing files failed
+)
+
+// Sent to the frontend in a NODE_ERROR event. Failures only affect the
+// peer or transfer they came from, the rest of the node keeps going.
+type Error struct {
+	Kind       int
+	PeerId     string `json:",omitempty"`
+	TransferId string `json:",omitempty"`
+	Message    string
+}
+
+func (e Error) Error() string {
+	switch {
+	case e.TransferId != "":
+		return fmt.Sprintf("transfer %s: %s", e.TransferId, e.Message)
+	case e.PeerId != "":
+		return fmt.Sprintf("peer %s: %s", e.PeerId, e.Message)
+	}
+	return e.Message
+}
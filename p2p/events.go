@@ -0,0 +1,104 @@
+package p2p
+
+// Something the node wants whoever embeds it to know about, see Node.Events.
+// Use a type switch to tell them apart.
+type Event interface{ isEvent() }
+
+// A device was found on the network
+type PeerAdded struct{ Peer PeerInfo }
+
+// A device changed its name or address
+type PeerUpdated struct{ Peer PeerInfo }
+
+// A device went away
+type PeerRemoved struct{ PeerId string }
+
+// A device wants to send us files. Answer with Node.RespondToRequest,
+// or Node.AcceptFiles to only take some of them.
+type TransferRequested struct {
+	TransferId string
+	PeerId     string
+	Message    string
+	Files      []FilePreview
+	TotalSize  int64
+	Trusted    bool // the device proved it's one we've paired with
+}
+
+// How far along a transfer is. Sent every so often while
+// files are being sent or received, and once more when done.
+type TransferProgress struct {
+	TransferId string
+	PeerId     string // the sender, when we're receiving
+	Sending    bool
+	Report     ProgressReport
+}
+
+// All the files of a transfer were received and verified
+type TransferCompleted struct {
+	TransferId string
+	PeerId     string
+	SenderName string
+	Files      int
+}
+
+// A recipient has all the files we sent it, and checked them. Until
+// then, a transfer that's done sending could still be in flight.
+type TransferDelivered struct {
+	TransferId string
+	PeerId     string
+}
+
+// A transfer stopped before it was done. Rejected is set when a
+// recipient turned it down, Reason is empty if it gave no reason.
+type TransferFailed struct {
+	TransferId string
+	PeerId     string
+	Rejected   bool
+	TimedOut   bool // the recipient didn't answer the request in time
+	Cancelled  bool // the other side stopped it partway through
+	Corrupted  bool // the files didn't match their checksums
+	Reason     string
+}
+
+// Nobody answered a transfer request in time, so it was declined
+type RequestExpired struct {
+	TransferId string
+	PeerId     string
+}
+
+// The user should check that both devices show the same code.
+// Answer with Node.ConfirmPairing.
+type PairingRequested struct{ PairingCode }
+
+type Paired struct{ PeerId string }
+
+type PairingFailed struct{ PeerId string }
+
+// A device claimed to be one it couldn't prove it is
+type PeerImpersonated struct{ PeerId string }
+
+// A device we haven't paired with uses the name of one we have
+type PeerLookAlike struct {
+	PeerId   string
+	PairedId string
+}
+
+// The share link stopped working, since it expired
+type ShareExpired struct{ Url string }
+
+func (PeerAdded) isEvent()         {}
+func (PeerUpdated) isEvent()       {}
+func (PeerRemoved) isEvent()       {}
+func (TransferRequested) isEvent() {}
+func (TransferProgress) isEvent()  {}
+func (TransferCompleted) isEvent() {}
+func (TransferDelivered) isEvent() {}
+func (TransferFailed) isEvent()    {}
+func (RequestExpired) isEvent()    {}
+func (PairingRequested) isEvent()  {}
+func (Paired) isEvent()            {}
+func (PairingFailed) isEvent()     {}
+func (PeerImpersonated) isEvent()  {}
+func (PeerLookAlike) isEvent()     {}
+func (ShareExpired) isEvent()      {}
+func (Error) isEvent()             {}
@@ -14,41 +14,47 @@ import (
 type PeerInfo struct {
 	Ip            net.IP
 	Id            string
+	Name          string // what the user called the device
 	LastHeardFrom time.Time
 	Port          int
+
+	Version      int      // of the protocol, 0 if the device didn't say
+	DeviceType   string   // one of the device types, empty if unknown
+	OS           string   // like linux or android
+	Capabilities []string // what the device supports
 }
 
+// Finds peers using mDNS
 type PeerFinder struct {
 	devicePort     int
+	displayName    string
 	queryFrequency time.Duration
 	server         *mdns.Server
 	serviceType    string
 
-	peers map[string]PeerInfo
+	peers peerTable
 	mu    sync.Mutex
 
-	nodeEvents chan Message
-	ctx        context.Context
+	events chan Message
 }
 
-func NewPeerFinder(
-	devicePort int, ctx context.Context, nodeEvents chan Message) PeerFinder {
-	return PeerFinder{
+func NewPeerFinder(devicePort int, displayName string) *PeerFinder {
+	return &PeerFinder{
+		displayName:    displayName,
 		serviceType:    "_fileshare._tcp.local.",
 		queryFrequency: time.Second * 10,
-		peers:          make(map[string]PeerInfo),
+		peers:          newPeerTable(time.Now),
 		devicePort:     devicePort,
-		ctx:            ctx,
-		nodeEvents:     nodeEvents,
 	}
 }
 
 func (f *PeerFinder) broadcastOurService() error {
-	hostname := fmt.Sprintf("%s.local.", deviceName())
+	hostname := fmt.Sprintf("%s.local.", deviceId())
+	txt := txtRecord(f.displayName)
 
 	service, err := mdns.NewMDNSService(
-		deviceName(), f.serviceType, "local.", hostname,
-		f.devicePort, []net.IP{deviceIP()}, []string{})
+		deviceId(), f.serviceType, "local.", hostname,
+		f.devicePort, localIPs(), txt)
 	if err != nil {
 		return err
 	}
@@ -58,30 +64,36 @@ func (f *PeerFinder) broadcastOurService() error {
 }
 
 func (f *PeerFinder) addPeer(entry *mdns.ServiceEntry) {
-	peerId := strings.Split(entry.Host, ".")[0]
-	if peerId == deviceName() {
+	// devices that predate the TXT record only have their id in the hostname
+	info := PeerInfo{Ip: entry.AddrV4, Id: strings.Split(entry.Host, ".")[0], Port: entry.Port}
+	parseTXTRecord(entry.InfoFields, &info)
+	if info.Id == deviceId() {
 		return
 	}
+	if info.Name == "" {
+		info.Name = info.Id
+	}
+	f.peers.heardFrom(info, f.events)
+}
 
+func (f *PeerFinder) SetDisplayName(name string) error {
 	f.mu.Lock()
-	if info, exists := f.peers[peerId]; exists {
-		info.LastHeardFrom = time.Now()
-		f.peers[peerId] = info
-	} else {
-		info := PeerInfo{
-			Ip:            entry.AddrV4,
-			Id:            peerId,
-			LastHeardFrom: time.Now(),
-			Port:          entry.Port,
-		}
-		f.peers[peerId] = info
-		f.nodeEvents <- NewMessage(ADDED_PEER, info)
+	defer f.mu.Unlock()
+
+	f.displayName = name
+	if f.server == nil {
+		return nil // we haven't started broadcasting yet
 	}
-	f.mu.Unlock()
+	if err := f.server.Shutdown(); err != nil {
+		return err
+	}
+	return f.broadcastOurService()
 }
 
+func (f *PeerFinder) Forget(peerId string) { f.peers.forget(peerId) }
+
 // Listen for broadcasts from other devices every 10 seconds
-func (f *PeerFinder) listenForBroadcasts() error {
+func (f *PeerFinder) listenForBroadcasts(ctx context.Context) error {
 	// Start lisening to the broadcasts of other devices
 	entriesChannel := make(chan *mdns.ServiceEntry, 25)
 	defer close(entriesChannel)
@@ -101,36 +113,34 @@ func (f *PeerFinder) listenForBroadcasts() error {
 			return err
 		}
 
-		// Remove peers we haven't heard from in a while. We don't close
-		// the peer connection here, because it would have already been
-		// closed since the webrtc connection would be disrupted.
-		f.mu.Lock()
-		limit := f.queryFrequency * 3
-		for key, peer := range f.peers {
-			if time.Since(peer.LastHeardFrom) >= limit {
-				delete(f.peers, key)
-			}
-		}
-		f.mu.Unlock()
+		// Remove peers we haven't heard from in a while
+		f.peers.expire(f.queryFrequency*3, f.events)
 
 		// Stop looping when we receive a shutdown signal
 		select {
-		case <-f.ctx.Done():
-			return f.ctx.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 			continue
 		}
 	}
 }
 
-func (f *PeerFinder) Run() error {
-	if err := f.broadcastOurService(); err != nil {
+func (f *PeerFinder) Run(ctx context.Context, events chan Message) error {
+	f.events = events
+
+	f.mu.Lock()
+	err := f.broadcastOurService()
+	f.mu.Unlock()
+	if err != nil {
 		return err
 	}
 
-	if err := f.listenForBroadcasts(); err != nil {
+	if err := f.listenForBroadcasts(ctx); err != nil && ctx.Err() == nil {
 		return err
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.server.Shutdown()
 }
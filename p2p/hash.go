@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+const (
+	chunkSize        = 256 * 1024
+	maxCorruptChunks = 10 // give up on a file after this many bad chunks
+)
+
+func hashChunk(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Copy a reader that doesn't support random access to a temporary
+// file, so that it can be hashed before being sent
+func (f *File) spool() error {
+	temp, err := os.CreateTemp("", "drip-*")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+
+	if _, err := io.Copy(temp, f.reader); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	f.reader.Close()
+
+	reader, err := os.Open(temp.Name())
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	f.reader = reader
+	f.spooledPath = temp.Name()
+	return nil
+}
+
+// Compute the whole file digest and the hash of every chunk
+func (f *File) computeHashes() error {
+	if _, seekable := f.reader.(io.ReaderAt); !seekable && f.sourcePath == "" {
+		if err := f.spool(); err != nil {
+			return err
+		}
+	}
+
+	source, release, err := f.openReader()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	reader := io.NewSectionReader(source, 0, f.Size)
+	digest := sha256.New()
+	buffer := make([]byte, chunkSize)
+	f.ChunkHashes = nil
+
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			digest.Write(buffer[:n])
+			f.ChunkHashes = append(f.ChunkHashes, hashChunk(buffer[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	f.Digest = digest.Sum(nil)
+	return nil
+}
+
+// Check that a chunk is where it should be and has the expected contents
+func (f *File) verifyChunk(chunk Chunk) bool {
+	if chunk.Offset < 0 || chunk.Offset%chunkSize != 0 {
+		return false
+	}
+
+	index := chunk.Offset / chunkSize
+	if index >= int64(len(f.ChunkHashes)) {
+		return false
+	}
+
+	expectedSize := min(chunkSize, f.Size-chunk.Offset)
+	if int64(len(chunk.Data)) != expectedSize {
+		return false
+	}
+	return bytes.Equal(hashChunk(chunk.Data), f.ChunkHashes[index])
+}
+
+// Check the whole file that was written against the digest
+func (f *File) verifyDigest() bool {
+	sum := sha256.Sum256(f.writer)
+	return bytes.Equal(sum[:], f.Digest)
+}
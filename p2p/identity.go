@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// The long term keypair that lets other devices recognize us
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// The id of this device. It's set once the node starts, while
+// the discovery of a node that just stopped might still read it.
+var localDeviceId atomic.Value
+
+// Derive a device id from a public key so that nobody
+// can claim an id without also owning the private key
+func DeviceIdFromKey(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(encoding.EncodeToString(sum[:16]))
+}
+
+func (i Identity) DeviceId() string { return DeviceIdFromKey(i.PublicKey) }
+
+func deviceId() string {
+	id, _ := localDeviceId.Load().(string)
+	return id
+}
+
+// The name shown to other devices until the user picks one
+func DefaultDisplayName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "drip"
+	}
+	return name
+}
+
+// Load our keypair, generating one the first time we run
+func LoadIdentity(dataFolder string) (Identity, error) {
+	path := filepath.Join(dataFolder, "identity.key")
+
+	seed, err := os.ReadFile(path)
+	if err == nil && len(seed) == ed25519.SeedSize {
+		key := ed25519.NewKeyFromSeed(seed)
+		return Identity{PublicKey: key.Public().(ed25519.PublicKey), privateKey: key}, nil
+	} else if err == nil {
+		// a new key would be a new device id, and paired devices would stop trusting us
+		return Identity{}, fmt.Errorf(
+			"%s is damaged, move it somewhere else to start over with a new identity", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return Identity{}, err
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := os.MkdirAll(dataFolder, 0700); err != nil {
+		return Identity{}, err
+	}
+	if err := os.WriteFile(path, private.Seed(), 0600); err != nil {
+		return Identity{}, err
+	}
+	return Identity{PublicKey: public, privateKey: private}, nil
+}
+
+func (i Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(i.privateKey, data)
+}
@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityLastsAcrossLaunches(t *testing.T) {
+	folder := t.TempDir()
+	first, err := LoadIdentity(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadIdentity(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.DeviceId() != second.DeviceId() {
+		t.Fatal("the device id changed")
+	}
+}
+
+func TestDamagedIdentityIsKept(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, "identity.key")
+	if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadIdentity(folder); err == nil {
+		t.Fatal("loaded a damaged identity")
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != "short" {
+		t.Fatal("the damaged identity was replaced")
+	}
+}
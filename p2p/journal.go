@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// how often the receiver persists its progress while chunks are arriving
+const journalInterval = time.Second
+
+// A half open byte range [Start, End) of a file
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// Merge a range into a sorted list of disjoint ranges
+func addRange(ranges []Range, r Range) []Range {
+	if r.End <= r.Start {
+		return ranges
+	}
+
+	merged := []Range{}
+	for _, existing := range ranges {
+		if existing.End < r.Start || existing.Start > r.End {
+			merged = append(merged, existing)
+			continue
+		}
+		r.Start = min(r.Start, existing.Start)
+		r.End = max(r.End, existing.End)
+	}
+	merged = append(merged, r)
+
+	slices.SortFunc(merged, func(a, b Range) int { return cmp.Compare(a.Start, b.Start) })
+	return merged
+}
+
+// Get the ranges of [0, size) that aren't covered by the received ranges
+func missingRanges(received []Range, size int64) []Range {
+	missing := []Range{}
+	offset := int64(0)
+	for _, r := range received {
+		if r.Start > offset {
+			missing = append(missing, Range{offset, r.Start})
+		}
+		offset = max(offset, r.End)
+	}
+	if offset < size {
+		missing = append(missing, Range{offset, size})
+	}
+	return missing
+}
+
+// What's persisted to disk so that an interrupted transfer can be resumed
+type journal struct {
+	Transfer Transfer
+	Received map[string][]Range
+	Created  map[string]bool // the entries that weren't there before the transfer
+}
+
+func journalFolder(downloadFolder string) string {
+	return filepath.Join(downloadFolder, ".drip")
+}
+
+func journalPath(downloadFolder string, transferId string) string {
+	return filepath.Join(journalFolder(downloadFolder), transferId+".json")
+}
+
+func saveJournal(downloadFolder string, t *Transfer) error {
+	j := journal{Transfer: *t, Received: make(map[string][]Range), Created: make(map[string]bool)}
+	for name, file := range t.Files {
+		j.Received[name] = file.received
+		j.Created[name] = file.created
+	}
+
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(journalFolder(downloadFolder), 0755); err != nil {
+		return err
+	}
+
+	// write then rename so a crash can't leave a truncated journal behind
+	path := journalPath(downloadFolder, t.Id)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func removeJournal(downloadFolder string, transferId string) error {
+	err := os.Remove(journalPath(downloadFolder, transferId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Load the transfers that were interrupted in a previous session
+func loadJournals(downloadFolder string) ([]*Transfer, error) {
+	entries, err := os.ReadDir(journalFolder(downloadFolder))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	transfers := []*Transfer{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(journalFolder(downloadFolder), entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var j journal
+		if err := json.Unmarshal(data, &j); err != nil {
+			continue // ignore corrupted journals
+		}
+
+		t := j.Transfer
+		for name, file := range t.Files {
+			file.received = j.Received[name]
+			file.created = j.Created[name]
+		}
+		t.suspended = true
+		transfers = append(transfers, &t)
+	}
+	return transfers, nil
+}
@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAddRange(t *testing.T) {
+	tests := map[string]struct {
+		ranges []Range
+		add    Range
+		want   []Range
+	}{
+		"first":        {nil, Range{0, 10}, []Range{{0, 10}}},
+		"empty":        {[]Range{{0, 10}}, Range{20, 20}, []Range{{0, 10}}},
+		"disjoint":     {[]Range{{20, 30}}, Range{0, 10}, []Range{{0, 10}, {20, 30}}},
+		"overlapping":  {[]Range{{0, 10}}, Range{5, 15}, []Range{{0, 15}}},
+		"adjacent":     {[]Range{{0, 10}}, Range{10, 20}, []Range{{0, 20}}},
+		"inside":       {[]Range{{0, 30}}, Range{10, 20}, []Range{{0, 30}}},
+		"filling gaps": {[]Range{{0, 10}, {20, 30}, {40, 50}}, Range{10, 40}, []Range{{0, 50}}},
+	}
+	for name, test := range tests {
+		if got := addRange(test.ranges, test.add); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	tests := map[string]struct {
+		received []Range
+		want     []Range
+	}{
+		"nothing":    {nil, []Range{{0, 100}}},
+		"everything": {[]Range{{0, 100}}, []Range{}},
+		"the start":  {[]Range{{0, 40}}, []Range{{40, 100}}},
+		"the end":    {[]Range{{60, 100}}, []Range{{0, 60}}},
+		"some parts": {[]Range{{10, 20}, {50, 60}}, []Range{{0, 10}, {20, 50}, {60, 100}}},
+	}
+	for name, test := range tests {
+		if got := missingRanges(test.received, 100); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestJournalsSurviveARestart(t *testing.T) {
+	folder := t.TempDir()
+	transfer := &Transfer{Id: uuid.NewString(), Sender: "sender", Files: map[string]*File{
+		"a": {Name: "a", Size: 100, Kind: REGULAR_FILE, received: []Range{{0, 40}}, created: true},
+		"b": {Name: "b", Size: 50, Kind: REGULAR_FILE},
+	}}
+	if err := saveJournal(folder, transfer); err != nil {
+		t.Fatal(err)
+	}
+	// a journal that was only partly written, from some other transfer
+	corrupt := journalPath(folder, uuid.NewString())
+	if err := os.WriteFile(corrupt, []byte(`{"Transfer": {"Id"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadJournals(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0].Id != transfer.Id {
+		t.Fatalf("loaded %d transfers instead of just the one that was saved", len(loaded))
+	}
+	restored := loaded[0]
+	if !restored.suspended || restored.Sender != "sender" {
+		t.Error("the transfer wasn't restored as it was")
+	}
+	a, b := restored.Files["a"], restored.Files["b"]
+	if !slices.Equal(a.received, []Range{{0, 40}}) || !a.created {
+		t.Errorf("restored a as %v, created %v", a.received, a.created)
+	}
+	if len(b.received) != 0 || b.created {
+		t.Errorf("restored b as %v, created %v", b.received, b.created)
+	}
+
+	if err := removeJournal(folder, transfer.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath(folder, transfer.Id)); !os.IsNotExist(err) {
+		t.Error("the journal wasn't removed")
+	}
+	if entries, _ := os.ReadDir(journalFolder(folder)); len(entries) != 1 ||
+		entries[0].Name() != filepath.Base(corrupt) {
+		t.Error("removing a journal touched the others")
+	}
+}
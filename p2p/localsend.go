@@ -0,0 +1,444 @@
+package p2p
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalSend (https://localsend.org) is an open protocol for sharing files on
+// a local network, with apps for devices drip doesn't run on. We speak version
+// 2 of it alongside our own protocol. LocalSend devices are found through its
+// multicast announcements and show up as ordinary peers, files they send go
+// through the same requests and download folder, and files we send them are
+// uploaded over its https api instead of a data channel.
+const (
+	localSendGroup     = "224.0.0.167:53317"
+	localSendPort      = 53317
+	localSendApi       = "/api/localsend/v2"
+	localSendVersion   = "2.1"
+	localSendPrefix    = "localsend-" // the peer ids of LocalSend devices start with this
+	localSendFrequency = time.Second * 30
+	maxLocalSendBody   = 16 << 20 // for everything but the files themselves
+)
+
+type LocalSendConfig struct {
+	Enabled bool
+	Port    int // where the api listens, 53317 if 0, which is what LocalSend expects
+}
+
+// How LocalSend devices describe themselves
+type localSendInfo struct {
+	Alias       string `json:"alias"`
+	Version     string `json:"version"`
+	DeviceModel string `json:"deviceModel,omitempty"`
+	DeviceType  string `json:"deviceType,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"`
+	Download    bool   `json:"download"`
+}
+
+type localSendAnnouncement struct {
+	localSendInfo
+	Announce     bool `json:"announce"`
+	Announcement bool `json:"announcement"` // what version 1 called it
+}
+
+type localSendFile struct {
+	Id       string `json:"id"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	FileType string `json:"fileType"`
+}
+
+type localSendPrepare struct {
+	Info  localSendInfo            `json:"info"`
+	Files map[string]localSendFile `json:"files"` // file id -> file
+}
+
+type localSendSessionInfo struct {
+	SessionId string            `json:"sessionId"`
+	Files     map[string]string `json:"files"` // file id -> token, only for the accepted files
+}
+
+func (info localSendInfo) valid() bool {
+	return info.Fingerprint != "" && len(info.Fingerprint) <= 256 &&
+		info.Port > 0 && info.Port <= 65535 &&
+		(info.Protocol == "http" || info.Protocol == "https")
+}
+
+type localSendDevice struct {
+	info      localSendInfo
+	ip        net.IP
+	lastHeard time.Time
+}
+
+func (d localSendDevice) url(endpoint string) string {
+	host := net.JoinHostPort(d.ip.String(), strconv.Itoa(d.info.Port))
+	return fmt.Sprintf("%s://%s%s/%s", d.info.Protocol, host, localSendApi, endpoint)
+}
+
+type localSend struct {
+	node        *Node
+	port        int
+	alias       string
+	fingerprint string
+	certificate tls.Certificate
+	client      *http.Client
+
+	devices  map[string]localSendDevice  // peer id -> device
+	outgoing map[string]*localSendUpload // see uploadKey
+	now      func() time.Time            // swapped out to control time
+	mu       sync.Mutex
+}
+
+func newLocalSend(n *Node, config LocalSendConfig) (*localSend, error) {
+	certificate, fingerprint, err := newLocalSendCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &localSend{
+		node:        n,
+		port:        cmp.Or(config.Port, localSendPort),
+		alias:       n.displayName,
+		fingerprint: fingerprint,
+		certificate: certificate,
+		// every LocalSend device has a self signed certificate,
+		// so there's nothing to check them against
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+		devices:  make(map[string]localSendDevice),
+		outgoing: make(map[string]*localSendUpload),
+		now:      time.Now,
+	}, nil
+}
+
+// LocalSend identifies devices by the hash of their certificate
+func newLocalSendCertificate() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "drip"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	hash := sha256.Sum256(der)
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return certificate, strings.ToUpper(hex.EncodeToString(hash[:])), nil
+}
+
+// LocalSend's device types, as ours
+var localSendDeviceTypes = map[string]string{
+	"mobile": PHONE_DEVICE, "desktop": DESKTOP_DEVICE, "server": SERVER_DEVICE, "headless": SERVER_DEVICE}
+
+func (l *localSend) info() localSendInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	deviceType := "desktop"
+	if runtime.GOOS == "android" || runtime.GOOS == "ios" {
+		deviceType = "mobile"
+	}
+	return localSendInfo{
+		Alias: l.alias, Version: localSendVersion, DeviceModel: "drip", DeviceType: deviceType,
+		Fingerprint: l.fingerprint, Port: l.port, Protocol: "https", Download: false,
+	}
+}
+
+func (l *localSend) setAlias(name string) {
+	l.mu.Lock()
+	l.alias = name
+	l.mu.Unlock()
+}
+
+func (l *localSend) isDevice(peerId string) bool {
+	if !strings.HasPrefix(peerId, localSendPrefix) {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, exists := l.devices[peerId]
+	return exists
+}
+
+func (l *localSend) device(peerId string) (localSendDevice, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	device, exists := l.devices[peerId]
+	return device, exists
+}
+
+// Add or update a device, returning its peer id
+func (l *localSend) heardFrom(info localSendInfo, ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	id := localSendPrefix + info.Fingerprint
+	l.mu.Lock()
+	now := l.now()
+	old, known := l.devices[id]
+	l.devices[id] = localSendDevice{info: info, ip: ip, lastHeard: now}
+	l.mu.Unlock()
+
+	peer := PeerInfo{Ip: ip, Id: id, Name: cmp.Or(info.Alias, id), Port: info.Port, LastHeardFrom: now}
+	// LocalSend has its own versions, and none of our capabilities
+	peer.DeviceType = localSendDeviceTypes[info.DeviceType]
+	peer.Capabilities = []string{}
+	if !known {
+		l.node.emit(PeerAdded{Peer: peer})
+	} else if old.info.Alias != info.Alias || old.info.Port != info.Port || !old.ip.Equal(ip) {
+		l.node.emit(PeerUpdated{Peer: peer})
+	}
+	if !known || old.info.Alias != info.Alias {
+		l.node.checkLookAlike(peer) // it can't have paired with us
+	}
+	return id
+}
+
+// Forget the devices we haven't heard from in a while, like the beacon does
+func (l *localSend) expire(limit time.Duration) {
+	l.mu.Lock()
+	expired := []string{}
+	for id, device := range l.devices {
+		if l.now().Sub(device.lastHeard) >= limit {
+			delete(l.devices, id)
+			expired = append(expired, id)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, id := range expired {
+		l.node.emit(PeerRemoved{PeerId: id})
+	}
+}
+
+func (l *localSend) api() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+localSendApi+"/info", l.handleInfo)
+	mux.HandleFunc("POST "+localSendApi+"/register", l.handleRegister)
+	mux.HandleFunc("POST "+localSendApi+"/prepare-upload", l.handlePrepareUpload)
+	mux.HandleFunc("POST "+localSendApi+"/upload", l.handleUpload)
+	mux.HandleFunc("POST "+localSendApi+"/cancel", l.handleCancel)
+	return mux
+}
+
+// Serve the api and announce ourselves until the context is cancelled
+func (l *localSend) run(ctx context.Context) error {
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", l.port),
+		&tls.Config{Certificates: []tls.Certificate{l.certificate}})
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: l.api()}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to serve the LocalSend api: %v\n", err)
+		}
+	}()
+	defer server.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", localSendGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	sender, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer sender.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(localSendFrequency)
+		defer ticker.Stop()
+		for {
+			if _, err := sender.Write(l.announcement(true)); err != nil {
+				log.Printf("Failed to send a LocalSend announcement: %v\n", err)
+			}
+			// announcing gets every device to answer, so quiet ones are gone
+			l.expire(localSendFrequency * 3)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	buffer := make([]byte, maxBeaconSize*4)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var announcement localSendAnnouncement
+		if json.Unmarshal(buffer[:n], &announcement) != nil || !announcement.valid() ||
+			announcement.Fingerprint == l.fingerprint {
+			continue
+		}
+		id := l.heardFrom(announcement.localSendInfo, addr.IP)
+		if announcement.Announce || announcement.Announcement {
+			go l.answerAnnouncement(ctx, id, sender)
+		}
+	}
+}
+
+func (l *localSend) announcement(announce bool) []byte {
+	data, err := json.Marshal(localSendAnnouncement{
+		localSendInfo: l.info(), Announce: announce, Announcement: announce})
+	if err != nil {
+		panic(err) // an announcement's fields can always be encoded
+	}
+	return data
+}
+
+// Let a device that just announced itself know about us, falling
+// back to multicast if it can't be reached directly
+func (l *localSend) answerAnnouncement(ctx context.Context, peerId string, sender *net.UDPConn) {
+	device, exists := l.device(peerId)
+	if !exists {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	body, _ := json.Marshal(l.info())
+	response, err := l.post(ctx, device.url("register"), body)
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			return
+		}
+	}
+	sender.Write(l.announcement(false))
+}
+
+func (l *localSend) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return l.client.Do(request)
+}
+
+func writeLocalSendJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func remoteIp(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (l *localSend) handleInfo(w http.ResponseWriter, r *http.Request) {
+	writeLocalSendJSON(w, l.info())
+}
+
+func (l *localSend) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var info localSendInfo
+	err := json.NewDecoder(io.LimitReader(r.Body, maxLocalSendBody)).Decode(&info)
+	if err != nil || !info.valid() {
+		http.Error(w, "invalid device info", http.StatusBadRequest)
+		return
+	}
+	if info.Fingerprint != l.fingerprint {
+		l.heardFrom(info, remoteIp(r))
+	}
+	writeLocalSendJSON(w, l.info())
+}
+
+// A device wants to send us files. The sender waits on the response
+// while we ask the user, like it would with another LocalSend app.
+func (l *localSend) handlePrepareUpload(w http.ResponseWriter, r *http.Request) {
+	var prepare localSendPrepare
+	err := json.NewDecoder(io.LimitReader(r.Body, maxLocalSendBody)).Decode(&prepare)
+	if err != nil || !prepare.Info.valid() {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	peerId := l.heardFrom(prepare.Info, remoteIp(r))
+
+	files := []offeredFile{}
+	for id, f := range prepare.Files {
+		files = append(files, offeredFile{Id: id, Name: f.FileName, Size: f.Size, MimeType: f.FileType})
+	}
+	sessionId, tokens, err := l.node.uploads.request(
+		r.Context(), peerId, cmp.Or(prepare.Info.Alias, peerId), files)
+	if errors.Is(err, errWithdrawn) {
+		return
+	} else if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeLocalSendJSON(w, localSendSessionInfo{SessionId: sessionId, Files: tokens})
+}
+
+func (l *localSend) handleUpload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	err := l.node.uploads.receive(
+		query.Get("sessionId"), query.Get("fileId"), query.Get("token"), r.Body, interruptBody(w))
+	if err != nil {
+		writeUploadError(w, err)
+	}
+}
+
+// The sender stopped sending
+func (l *localSend) handleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("sessionId")
+	sender, exists := l.node.uploads.discard(id)
+	if !exists {
+		writeUploadError(w, errUnknownSession)
+		return
+	}
+	l.node.emit(TransferFailed{TransferId: id, PeerId: sender, Cancelled: true})
+}
@@ -0,0 +1,276 @@
+package p2p
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Files we're uploading to a LocalSend device as part of one of our
+// transfers. The sender treats the device like any other recipient,
+// and the messages it sends are translated into calls to its api.
+type localSendUpload struct {
+	device    localSendDevice
+	sessionId string
+	tokens    map[string]string // file name -> token
+	files     map[uint32]*File  // file index -> file, named after its key in the transfer
+
+	body   *io.PipeWriter // the file being uploaded right now
+	result chan error     // what came of uploading it
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func uploadKey(transferId string, peerId string) string { return transferId + "/" + peerId }
+
+func (l *localSend) upload(transferId string, peerId string) *localSendUpload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.outgoing[uploadKey(transferId, peerId)]
+}
+
+// Handle a message the node meant for a LocalSend device. The
+// rest, like pairing and pausing, has no equivalent in LocalSend.
+func (l *localSend) deliver(peerId string, msg Message) {
+	switch msg.Type {
+	case TRANSFER_REQUEST:
+		request, err := Deserialize[TransferRequest](msg)
+		if err == nil {
+			go l.prepareUpload(peerId, request)
+		}
+	case TRANSFER_INFO:
+		info, err := Deserialize[Transfer](msg)
+		if err == nil {
+			l.startUpload(peerId, info)
+		}
+	case TRANSFER_CHUNK:
+		chunk, err := GetChunk(msg)
+		if err == nil {
+			l.uploadChunk(peerId, chunk)
+		}
+	case TRANSFER_CANCELLED:
+		id, err := Deserialize[string](msg)
+		if err == nil {
+			l.cancelUpload(peerId, id)
+		}
+	}
+}
+
+// Pass a message to the node as if the device had sent it over a data channel
+func (l *localSend) reply(peerId string, msgType int, value any) {
+	msg := NewMessage(msgType, value)
+	msg.Sender = peerId
+	l.node.handlePeerMessage(msg)
+}
+
+// Give up on sending to the device
+func (l *localSend) failUpload(peerId string, transferId string, reason string) {
+	l.mu.Lock()
+	upload, exists := l.outgoing[uploadKey(transferId, peerId)]
+	delete(l.outgoing, uploadKey(transferId, peerId))
+	l.mu.Unlock()
+	if !exists {
+		return
+	}
+	upload.cancel()
+	if upload.body != nil {
+		upload.body.Close()
+	}
+	l.reply(peerId, TRANSFER_INVALID, ManifestRejection{TransferId: transferId, Reason: reason})
+}
+
+// Ask the device to take the files, which waits on its user
+func (l *localSend) prepareUpload(peerId string, request TransferRequest) {
+	device, exists := l.device(peerId)
+	if !exists {
+		return
+	}
+	ctx, cancel := context.WithCancel(l.node.ctx)
+	upload := &localSendUpload{device: device, ctx: ctx, cancel: cancel}
+	l.mu.Lock()
+	l.outgoing[uploadKey(request.TransferId, peerId)] = upload
+	l.mu.Unlock()
+
+	// LocalSend only knows about files, the folders they're in are implied by their paths
+	files := make(map[string]localSendFile)
+	for _, p := range request.Files {
+		if p.Kind == REGULAR_FILE {
+			files[p.Name] = localSendFile{
+				Id: p.Name, FileName: p.Name, Size: p.Size,
+				FileType: cmp.Or(p.MimeType, "application/octet-stream")}
+		}
+	}
+	body, _ := json.Marshal(localSendPrepare{Info: l.info(), Files: files})
+
+	response, err := l.post(ctx, device.url("prepare-upload"), body)
+	if err != nil {
+		if ctx.Err() == nil {
+			l.failUpload(peerId, request.TransferId, fmt.Sprintf("couldn't reach the device: %v", err))
+		}
+		return
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		var session localSendSessionInfo
+		err := json.NewDecoder(io.LimitReader(response.Body, maxLocalSendBody)).Decode(&session)
+		if err != nil {
+			l.failUpload(peerId, request.TransferId, "the device sent an invalid response")
+			return
+		}
+		if len(session.Files) == 0 {
+			break // no files are accepted, which isn't the same as an empty list here
+		}
+		l.mu.Lock()
+		upload.sessionId = session.SessionId
+		upload.tokens = session.Files
+		l.mu.Unlock()
+		response := TransferResponse{
+			TransferId: request.TransferId, Authorized: true,
+			Files: slices.Collect(maps.Keys(session.Files))}
+		l.reply(peerId, TRANSFER_RESPONSE, response)
+		return
+
+	case http.StatusNoContent, http.StatusForbidden:
+		// the device doesn't want anything, whether or not it asked its user
+	default:
+		l.failUpload(peerId, request.TransferId, fmt.Sprintf("the device refused: %s", response.Status))
+		return
+	}
+
+	l.mu.Lock()
+	delete(l.outgoing, uploadKey(request.TransferId, peerId))
+	l.mu.Unlock()
+	cancel()
+	l.reply(peerId, TRANSFER_RESPONSE, TransferResponse{TransferId: request.TransferId})
+}
+
+// The sender is about to send the files, empty ones don't get any chunks so they're sent now
+func (l *localSend) startUpload(peerId string, info Transfer) {
+	upload := l.upload(info.Id, peerId)
+	if upload == nil {
+		return
+	}
+	upload.files = make(map[uint32]*File)
+	for name, f := range info.Files {
+		f.Name = name
+		upload.files[f.Index] = f
+	}
+
+	for _, f := range info.orderedFiles() {
+		if f.Kind != REGULAR_FILE || f.Size != 0 {
+			continue
+		}
+		if err := l.postFile(upload, f, http.NoBody); err != nil {
+			l.failUpload(peerId, info.Id, err.Error())
+			return
+		}
+	}
+}
+
+// Stream a chunk into the upload of the file it belongs to. Files are
+// sent one at a time and in order, so each one is a single request.
+func (l *localSend) uploadChunk(peerId string, chunk Chunk) {
+	upload := l.upload(chunk.TransferId, peerId)
+	if upload == nil {
+		return
+	}
+	f, exists := upload.files[chunk.FileIndex]
+	if !exists {
+		return
+	}
+
+	if chunk.Offset == 0 {
+		reader, writer := io.Pipe()
+		upload.body = writer
+		upload.result = make(chan error, 1)
+		go func() {
+			err := l.postFile(upload, f, reader)
+			reader.CloseWithError(cmp.Or(err, io.ErrClosedPipe))
+			upload.result <- err
+		}()
+	}
+	if upload.body == nil {
+		return // LocalSend can't resume, so a resent chunk has nowhere to go
+	}
+
+	if err := l.node.limiter.wait(upload.ctx, peerId, len(chunk.Data)); err != nil {
+		return
+	}
+	if _, err := upload.body.Write(chunk.Data); err != nil {
+		// the request ended early, and says why
+		err = cmp.Or(<-upload.result, err)
+		l.failUpload(peerId, chunk.TransferId, err.Error())
+		return
+	}
+
+	if chunk.Offset+int64(len(chunk.Data)) == f.Size {
+		upload.body.Close()
+		upload.body = nil
+		if err := <-upload.result; err != nil {
+			l.failUpload(peerId, chunk.TransferId, err.Error())
+		}
+	}
+}
+
+func (l *localSend) postFile(upload *localSendUpload, f *File, body io.Reader) error {
+	l.mu.Lock()
+	query := url.Values{
+		"sessionId": {upload.sessionId}, "fileId": {f.Name}, "token": {upload.tokens[f.Name]}}
+	l.mu.Unlock()
+
+	request, err := http.NewRequestWithContext(
+		upload.ctx, http.MethodPost, upload.device.url("upload")+"?"+query.Encode(), body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = f.Size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := l.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s: %w", f.Name, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the device refused %s: %s", f.Name, response.Status)
+	}
+	return nil
+}
+
+// We stopped sending, so let the device know
+func (l *localSend) cancelUpload(peerId string, transferId string) {
+	l.mu.Lock()
+	upload, exists := l.outgoing[uploadKey(transferId, peerId)]
+	delete(l.outgoing, uploadKey(transferId, peerId))
+	sessionId := ""
+	if exists {
+		sessionId = upload.sessionId
+	}
+	l.mu.Unlock()
+	if !exists {
+		return
+	}
+	upload.cancel()
+	if sessionId == "" {
+		return // still waiting on the device, which notices the request going away
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(l.node.ctx, time.Second*5)
+		defer cancel()
+		query := url.Values{"sessionId": {sessionId}}
+		response, err := l.post(ctx, upload.device.url("cancel")+"?"+query.Encode(), nil)
+		if err == nil {
+			response.Body.Close()
+		}
+	}()
+}
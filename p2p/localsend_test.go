@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Talk to our LocalSend api the way a LocalSend app would
+func TestLocalSendUpload(t *testing.T) {
+	n := newTestNode(t)
+	l, err := newLocalSend(n, LocalSendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewTLSServer(l.api())
+	defer server.Close()
+	client := server.Client()
+	post := func(endpoint string, body any) *http.Response {
+		t.Helper()
+		encoded, _ := json.Marshal(body)
+		response, err := client.Post(server.URL+localSendApi+endpoint, "application/json", bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	phone := localSendInfo{
+		Alias: "phone", Version: "2.1", DeviceType: "mobile",
+		Fingerprint: "f1ngerpr1nt", Port: 53317, Protocol: "https"}
+
+	response := post("/register", phone)
+	var us localSendInfo
+	json.NewDecoder(response.Body).Decode(&us)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || us.Fingerprint != l.fingerprint {
+		t.Fatalf("registering failed with %s", response.Status)
+	}
+	if added := nextEvent[PeerAdded](t, n); added.Peer.Id != localSendPrefix+phone.Fingerprint ||
+		added.Peer.DeviceType != PHONE_DEVICE {
+		t.Fatalf("the phone showed up as %+v", added.Peer)
+	}
+
+	// the sender waits on the response while the user is asked
+	prepared := make(chan *http.Response)
+	go func() {
+		prepared <- post("/prepare-upload", localSendPrepare{Info: phone, Files: map[string]localSendFile{
+			"photo": {Id: "photo", FileName: "photo.jpg", Size: 5, FileType: "image/jpeg"}}})
+	}()
+	request := nextEvent[TransferRequested](t, n)
+	if len(request.Files) != 1 || request.Files[0].Name != "photo.jpg" {
+		t.Fatalf("asked about %+v", request.Files)
+	}
+	n.RespondToRequest(request.TransferId, true)
+
+	response = <-prepared
+	var session localSendSessionInfo
+	json.NewDecoder(response.Body).Decode(&session)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || session.Files["photo"] == "" {
+		t.Fatalf("preparing the upload failed with %s", response.Status)
+	}
+
+	upload := func(token string) int {
+		url := server.URL + localSendApi + "/upload?sessionId=" + session.SessionId +
+			"&fileId=photo&token=" + token
+		response, err := client.Post(url, "image/jpeg", bytes.NewReader([]byte("hello")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if status := upload("wrong"); status != http.StatusForbidden {
+		t.Fatalf("an upload with the wrong token got %d", status)
+	}
+	if status := upload(session.Files["photo"]); status != http.StatusOK {
+		t.Fatalf("the upload failed with %d", status)
+	}
+
+	if completed := nextEvent[TransferCompleted](t, n); completed.TransferId != session.SessionId {
+		t.Fatalf("completed %s instead of %s", completed.TransferId, session.SessionId)
+	}
+	contents, err := os.ReadFile(filepath.Join(*n.receiver.downloadFolder, "photo.jpg"))
+	if err != nil || string(contents) != "hello" {
+		t.Fatalf("the photo was saved as %q, %v", contents, err)
+	}
+}
+
+func TestLocalSendDevicesExpire(t *testing.T) {
+	n := newTestNode(t)
+	l, err := newLocalSend(n, LocalSendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	l.now = clock.now
+	phone := localSendInfo{Alias: "phone", Fingerprint: "f1ngerpr1nt", Port: 53317, Protocol: "https"}
+	id := l.heardFrom(phone, net.IPv4(192, 168, 1, 5))
+	nextEvent[PeerAdded](t, n)
+
+	clock.advance(time.Minute)
+	l.expire(2 * time.Minute)
+	if !l.isDevice(id) {
+		t.Fatal("forgot a device that was heard from recently")
+	}
+	l.heardFrom(phone, net.IPv4(192, 168, 1, 5))
+	clock.advance(time.Minute)
+	l.expire(2 * time.Minute)
+	if !l.isDevice(id) {
+		t.Fatal("hearing from a device didn't keep it around")
+	}
+
+	clock.advance(time.Minute)
+	l.expire(2 * time.Minute)
+	if l.isDevice(id) {
+		t.Fatal("a device that went quiet wasn't forgotten")
+	}
+	if removed := nextEvent[PeerRemoved](t, n); removed.PeerId != id {
+		t.Fatalf("removed %s instead of %s", removed.PeerId, id)
+	}
+}
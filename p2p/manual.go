@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Adding devices discovery can't find, like on networks that drop
+// multicast. They're probed directly, and show up once they answer,
+// just like devices discovery finds.
+
+// What a device shows, usually as a qr code, so another one can add it.
+// The fingerprint lets the other device check it got to the right one,
+// so adding a device this way also pairs with it.
+type PairingPayload struct {
+	Ip          string
+	Port        int
+	Id          string
+	Fingerprint string // sha256 of the device's public key, in hex
+}
+
+const pairingScheme = "drip"
+
+func keyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// Something like drip://pair?ip=192.168.1.5&port=8000&id=...&key=...
+func (p PairingPayload) String() string {
+	query := url.Values{
+		"ip": {p.Ip}, "port": {strconv.Itoa(p.Port)}, "id": {p.Id}, "key": {p.Fingerprint}}
+	return (&url.URL{Scheme: pairingScheme, Host: "pair", RawQuery: query.Encode()}).String()
+}
+
+func ParsePairingPayload(text string) (PairingPayload, error) {
+	u, err := url.Parse(strings.TrimSpace(text))
+	if err != nil || u.Scheme != pairingScheme || u.Host != "pair" {
+		return PairingPayload{}, errors.New("not a pairing code")
+	}
+	query := u.Query()
+	p := PairingPayload{Ip: query.Get("ip"), Id: query.Get("id"), Fingerprint: query.Get("key")}
+	p.Port, err = strconv.Atoi(query.Get("port"))
+	if err != nil || p.Port <= 0 || p.Port > 65535 {
+		return PairingPayload{}, errors.New("the pairing code has an invalid port")
+	}
+	if net.ParseIP(p.Ip) == nil {
+		return PairingPayload{}, errors.New("the pairing code has an invalid ip")
+	}
+	if p.Id == "" {
+		return PairingPayload{}, errors.New("the pairing code has no device id")
+	}
+	if key, err := hex.DecodeString(p.Fingerprint); err != nil || len(key) != sha256.Size {
+		return PairingPayload{}, errors.New("the pairing code has an invalid key fingerprint")
+	}
+	return p, nil
+}
+
+// What other devices need to add this one
+func (n *Node) PairingPayload() PairingPayload {
+	return PairingPayload{
+		Ip:          localIPs()[0].String(),
+		Port:        n.port,
+		Id:          n.DeviceId(),
+		Fingerprint: keyFingerprint(n.identity.PublicKey),
+	}
+}
+
+// Look for a device at a host:port address. It's added
+// once it answers, and kept for as long as it does.
+func (n *Node) AddPeer(address string) error {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return fmt.Errorf("%q isn't an address like 192.168.1.5:8000", address)
+	}
+	number, err := strconv.Atoi(port)
+	if host == "" || err != nil || number <= 0 || number > 65535 {
+		return fmt.Errorf("%q isn't an address like 192.168.1.5:8000", address)
+	}
+	n.static.Add(net.JoinHostPort(host, port))
+	return nil
+}
+
+// Add the device a pairing code came from, and pair with
+// it once it proves it has the key the code describes
+func (n *Node) AddPeerFromPayload(text string) error {
+	p, err := ParsePairingPayload(text)
+	if err != nil {
+		return err
+	}
+	if p.Id == n.DeviceId() {
+		return errors.New("that's this device's pairing code")
+	}
+
+	n.mu.Lock()
+	n.scanned[p.Id] = strings.ToLower(p.Fingerprint)
+	key, connected := n.keys[p.Id]
+	n.mu.Unlock()
+	if connected {
+		n.checkScannedKey(p.Id, key) // it already said hello
+	}
+	return n.AddPeer(net.JoinHostPort(p.Ip, strconv.Itoa(p.Port)))
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Used when nothing else is configured
+const DefaultICEServers = "stun:stun.l.google.com:19302"
+
+const ( // data channel buffering defaults
+	defaultBufferHigh = 8 * 1024 * 1024 // stop sending once this much is waiting to go out
+	defaultBufferLow  = 2 * 1024 * 1024 // and start again once it drains to this
+)
+
+type NetworkConfig struct {
+	// Only gather host candidates, so that nothing outside
+	// the local network is ever contacted
+	LanOnly    bool
+	ICEServers []webrtc.ICEServer
+
+	// How many bytes a data channel can have buffered before sending waits,
+	// and how far it has to drain before sending carries on. 0 for the defaults.
+	BufferHigh uint64
+	BufferLow  uint64
+}
+
+func (c NetworkConfig) bufferThresholds() (uint64, uint64) {
+	high, low := c.BufferHigh, c.BufferLow
+	if high == 0 {
+		high = defaultBufferHigh
+	}
+	if low == 0 || low >= high {
+		low = min(defaultBufferLow, high/2)
+	}
+	return high, low
+}
+
+// Parse a comma separated list of ICE server urls. TURN credentials
+// go before the host, like turn:user:password@192.168.1.2:3478
+func ParseICEServers(spec string) ([]webrtc.ICEServer, error) {
+	servers := []webrtc.ICEServer{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		scheme, rest, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, fmt.Errorf("%q is missing a scheme", entry)
+		}
+		switch scheme {
+		case "stun", "stuns":
+			servers = append(servers, webrtc.ICEServer{URLs: []string{entry}})
+
+		case "turn", "turns":
+			server := webrtc.ICEServer{URLs: []string{entry}}
+			if userinfo, host, found := strings.Cut(rest, "@"); found {
+				username, credential, _ := strings.Cut(userinfo, ":")
+				server.URLs = []string{scheme + ":" + host}
+				server.Username = username
+				server.Credential = credential
+			}
+			servers = append(servers, server)
+
+		default:
+			return nil, fmt.Errorf("%q isn't a stun or turn url", entry)
+		}
+	}
+	return servers, nil
+}
+
+func (c NetworkConfig) webrtcConfig() webrtc.Configuration {
+	if c.LanOnly {
+		// without any servers the only candidates are our own addresses
+		return webrtc.Configuration{}
+	}
+	return webrtc.Configuration{ICEServers: c.ICEServers}
+}
+
+// Get the addresses of our network interfaces, without
+// needing to reach anything on the internet
+func localIPs() []net.IP {
+	ips := []net.IP{}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+
+	if len(ips) == 0 { // no network at all, at least be reachable locally
+		ips = append(ips, net.IPv4(127, 0, 0, 1))
+	}
+	return ips
+}
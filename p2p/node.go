@@ -2,119 +2,510 @@ package p2p
 
 import (
 	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 )
 
-// event types used to communicate between the peer to peer node and the frontend
-// TRANSFER_REQUEST, TRANSFER_RESPONSE and TRANSFER_CANCELLED are also used
+// events used within the node, between it, its peers and peer discovery
 const (
 	ADDED_PEER = iota + 200
 	REMOVED_PEER
-	NOTIFY_COMPLETION
-	SEND_FILES
-	AUTH_GRANTED
-	TRANSFER_REJECTED
+	PEER_CONNECTED
+	LOST_PEER
+	UPDATED_PEER
+	NODE_ERROR
 )
 
 type Node struct {
 	sender   Sender
 	receiver Receiver
-	finder   PeerFinder
+	finder   Discovery
+	static   *StaticDiscovery // also one of the finder's backends
 	peers    map[string]*PeerConnection
+	mu       sync.Mutex
 
-	appEvents  chan Message
+	identity    Identity
+	displayName string
+	trust       *TrustStore
+	pairings    map[string]*pairing
+	verified    map[string]bool              // peers that proved they're who we paired with
+	keys        map[string]ed25519.PublicKey // the keys connected peers proved they own
+	scanned     map[string]string            // peer id -> key fingerprint from a pairing code
+
+	events     chan Event
+	queue      []Event       // events the app hasn't read yet
+	queued     chan struct{} // there's something in the queue
+	queueMu    sync.Mutex
 	nodeEvents chan Message
+	requests   map[string]*pendingRequest // transfer id -> a request waiting for an answer
+
+	requestTimeout time.Duration
+	limiter        *rateLimiter
+	uploads        *uploadReceiver
+	localSend      *localSend // nil unless it's turned on
+	share          *webShare  // the share link, if there is one
+
+	network NetworkConfig
+	ctx     context.Context
+	port    int
+}
 
-	ctx  context.Context
-	port int
+type NodeConfig struct {
+	DataFolder     string // where our identity and trusted peers are kept
+	DisplayName    string
+	DownloadFolder *string
+	Port           int // picked at random if 0
+	Network        NetworkConfig
+	Discovery      DiscoveryConfig
+	RequestTimeout time.Duration // how long transfer requests wait for an answer
+	Limits         RateLimits
+	LocalSend      LocalSendConfig // also talk to LocalSend apps
+	DeviceType     string          // what other devices show us as, guessed from the os if empty
 }
 
-func NewNode(
-	ctx context.Context, downloadFolder *string,
-	appEvents chan Message, nodeEvents chan Message,
-) *Node {
+// How long a transfer request waits for an answer before it's declined
+const defaultRequestTimeout = 2 * time.Minute
+
+type pendingRequest struct {
+	sender string
+	timer  *time.Timer            // declines the request when it fires
+	answer func(TransferResponse) // gets the response back to the sender
+}
+
+func NewNode(ctx context.Context, config NodeConfig) (*Node, error) {
+	dataFolder := config.DataFolder
+	if config.Port == 0 {
+		port, err := getUnusedPort()
+		if err != nil {
+			return nil, err
+		}
+		config.Port = port
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	identity, err := LoadIdentity(dataFolder)
+	if err != nil {
+		return nil, err
+	}
+	localDeviceId.Store(identity.DeviceId())
+	if config.DeviceType != "" {
+		localDeviceType = config.DeviceType
+	}
+	trust, err := LoadTrustStore(dataFolder)
+	if err != nil {
+		return nil, err
+	}
+
 	n := &Node{
-		sender:     NewSender(),
-		receiver:   NewReceiver(downloadFolder, appEvents),
-		peers:      make(map[string]*PeerConnection),
-		appEvents:  appEvents,
-		nodeEvents: nodeEvents,
-		port:       getUnusedPort(),
-		ctx:        ctx,
+		peers:          make(map[string]*PeerConnection),
+		identity:       identity,
+		displayName:    config.DisplayName,
+		trust:          trust,
+		pairings:       make(map[string]*pairing),
+		verified:       make(map[string]bool),
+		keys:           make(map[string]ed25519.PublicKey),
+		scanned:        make(map[string]string),
+		events:         make(chan Event),
+		queued:         make(chan struct{}, 1),
+		nodeEvents:     make(chan Message),
+		requests:       make(map[string]*pendingRequest),
+		network:        config.Network,
+		requestTimeout: config.RequestTimeout,
+		limiter:        newRateLimiter(config.Limits),
+		port:           config.Port,
+		ctx:            ctx,
 	}
 
+	n.sender = NewSender(n.emit)
+	n.receiver = NewReceiver(config.DownloadFolder, n.emit)
+	n.uploads = newUploadReceiver(n)
 	go n.handleNodeEvents()
+	go n.deliverEvents()
+
+	if config.LocalSend.Enabled {
+		n.localSend, err = newLocalSend(n, config.LocalSend)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := n.localSend.run(ctx); err != nil {
+				n.reportError(Error{Kind: NETWORK_ERROR, Message: err.Error()})
+			}
+		}()
+	}
 
 	// find peers
-	n.finder = NewPeerFinder(n.port, ctx, n.nodeEvents)
+	n.static = NewStaticDiscovery(n.port, config.DisplayName, config.Discovery.StaticPeers)
+	n.finder = newNodeDiscovery(n.static, n.port, config.DisplayName, config.Discovery)
 	go func() {
-		if err := n.finder.Run(); err != nil {
-			panic(err)
+		if err := n.finder.Run(ctx, n.nodeEvents); err != nil {
+			n.reportError(Error{Kind: NETWORK_ERROR, Message: err.Error()})
 		}
 	}()
-	return n
+	return n, nil
+}
+
+// Everything the node has to say, in order. Events have to be read, or they pile up.
+func (n *Node) Events() <-chan Event { return n.events }
+
+// Queue an event for the app. This never blocks, since the app
+// calls into the node from the same loop that reads its events.
+func (n *Node) emit(event Event) {
+	n.queueMu.Lock()
+	n.queue = append(n.queue, event)
+	n.queueMu.Unlock()
+	select {
+	case n.queued <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// Pass queued events to the app until the node shuts down
+func (n *Node) deliverEvents() {
+	for {
+		n.queueMu.Lock()
+		pending := n.queue
+		n.queue = nil
+		n.queueMu.Unlock()
+
+		for _, event := range pending {
+			select {
+			case <-n.ctx.Done():
+				return
+			case n.events <- event:
+			}
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.queued:
+		}
+	}
+}
+
+func (n *Node) reportError(err Error) {
+	log.Printf("Failed: %v\n", err)
+	n.emit(err)
+}
+
+// Decode a message from a peer, reporting it if it's malformed
+func decode[T any](n *Node, msg Message) (T, bool) {
+	value, err := Deserialize[T](msg)
+	if err != nil {
+		n.reportError(Error{
+			Kind:    PROTOCOL_ERROR,
+			PeerId:  msg.Sender,
+			Message: fmt.Sprintf("malformed message: %v", err),
+		})
+	}
+	return value, err == nil
+}
+
+func newNodeDiscovery(
+	static *StaticDiscovery, port int, displayName string, config DiscoveryConfig) Discovery {
+	// the static backend also answers probes, so it's always used
+	backends := []Discovery{static}
+	if !config.NoMDNS {
+		backends = append(backends, NewPeerFinder(port, displayName))
+	}
+	if !config.NoBeacon {
+		backends = append(backends, NewBeaconDiscovery(port, displayName))
+	}
+	return NewDiscovery(backends...)
 }
 
 func (n *Node) SendFiles(recipients []string, files map[string]*File) string {
-	return n.sender.StartTransfer(recipients, files, n.sendMsg)
+	return n.sender.StartTransfer(recipients, files, n.displayName, n.sendMsg)
+}
+
+// Our id, derived from our public key, which stays the same across launches
+func (n *Node) DeviceId() string { return n.identity.DeviceId() }
+
+// Change the name other devices see us as
+func (n *Node) SetDisplayName(name string) error {
+	n.mu.Lock()
+	n.displayName = name // the share page reads it from another goroutine
+	n.mu.Unlock()
+	if n.localSend != nil {
+		n.localSend.setAlias(name)
+	}
+	return n.finder.SetDisplayName(name)
 }
 
-func (n *Node) GetProgressReport(transferId string) ProgressReport {
-	return n.sender.GetProgressReport(transferId)
+// Accept or decline files a peer wants to send us
+func (n *Node) RespondToRequest(transferId string, accept bool) {
+	n.respond(TransferResponse{TransferId: transferId, Authorized: accept})
 }
 
+// Only accept some of the files a peer wants to send us, using
+// the names from TransferRequested.Files. No files declines them all.
+func (n *Node) AcceptFiles(transferId string, files []string) {
+	if len(files) == 0 {
+		n.RespondToRequest(transferId, false)
+		return
+	}
+	n.respond(TransferResponse{TransferId: transferId, Authorized: true, Files: files})
+}
+
+func (n *Node) respond(response TransferResponse) {
+	request, exists := n.takeRequest(response.TransferId)
+	if !exists {
+		return
+	}
+	request.timer.Stop()
+	request.answer(response)
+}
+
+// Hold on to a request until the user answers it or it times out.
+// Returns false if we've already asked about it.
+func (n *Node) addRequest(transferId string, sender string, answer func(TransferResponse)) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, exists := n.requests[transferId]; exists {
+		return false
+	}
+	n.requests[transferId] = &pendingRequest{
+		sender: sender,
+		timer:  time.AfterFunc(n.requestTimeout, func() { n.expireRequest(transferId) }),
+		answer: answer,
+	}
+	return true
+}
+
+// Remove a request from the ones waiting for an answer
+func (n *Node) takeRequest(transferId string) (*pendingRequest, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	request, exists := n.requests[transferId]
+	delete(n.requests, transferId)
+	return request, exists
+}
+
+// Decline a request nobody answered in time, so its sender isn't left waiting
+func (n *Node) expireRequest(transferId string) {
+	request, exists := n.takeRequest(transferId)
+	if !exists {
+		return // answered just in time
+	}
+
+	request.answer(TransferResponse{TransferId: transferId, TimedOut: true})
+	n.emit(RequestExpired{TransferId: transferId, PeerId: request.sender})
+}
+
+// Change how fast files are sent, which applies right away
+func (n *Node) SetRateLimits(limits RateLimits) { n.limiter.setLimits(limits) }
+
+// Whether a transfer is being sent or received
+func (n *Node) HasTransfer(transferId string) bool {
+	return n.sender.HasTransfer(transferId) || n.receiver.HasTransfer(transferId) ||
+		n.uploads.has(transferId)
+}
+
+// Stop a transfer we're sending or receiving
 func (n *Node) CancelTransfer(transferId string) {
-	n.sender.CancelTransfer(transferId, n.sendMsg)
+	if n.sender.HasTransfer(transferId) {
+		n.sender.CancelTransfer(transferId, n.sendMsg)
+	} else if n.uploads.has(transferId) {
+		n.uploads.discard(transferId)
+	} else {
+		n.receiver.Cancel(transferId, n.sendMsg)
+	}
+}
+
+// Pause a transfer we're sending or receiving, keeping what's been sent so far
+func (n *Node) PauseTransfer(transferId string) { n.setPaused(transferId, true) }
+
+// Pick up a transfer we paused where it left off
+func (n *Node) UnpauseTransfer(transferId string) { n.setPaused(transferId, false) }
+
+func (n *Node) setPaused(transferId string, paused bool) {
+	if n.sender.HasTransfer(transferId) {
+		n.sender.SetPaused(transferId, paused, n.sendMsg)
+	} else {
+		n.receiver.SetPaused(transferId, paused, n.sendMsg)
+	}
 }
 
 func (n *Node) Shutdown() {
 	n.receiver.Close()
-	for _, peer := range n.peers {
+	n.sender.Close()
+	n.StopSharing()
+
+	// closing a peer sends an event that needs the lock
+	n.mu.Lock()
+	for _, request := range n.requests {
+		request.timer.Stop()
+	}
+	peers := slices.Collect(maps.Values(n.peers))
+	n.mu.Unlock()
+	for _, peer := range peers {
 		peer.Close()
 	}
 }
 
 func (n *Node) sendMsg(msg Message) {
-	for _, peer := range msg.Recipients {
+	for _, id := range msg.Recipients {
+		if n.localSend != nil && n.localSend.isDevice(id) {
+			n.localSend.deliver(id, msg)
+			continue
+		}
+
+		n.mu.Lock()
+		peer, exists := n.peers[id]
+		n.mu.Unlock()
+		if !exists {
+			continue // the peer disconnected, it'll ask us to resume later
+		}
+
 		if msg.Type == TRANSFER_CHUNK {
-			n.peers[peer].pendingChunks <- msg
+			peer.Queue(peer.pendingChunks, msg)
 		} else {
-			n.peers[peer].pendingMesages <- msg
+			peer.Queue(peer.pendingMesages, msg)
 		}
 	}
 }
 
 func (n *Node) addPeer(info PeerInfo) {
+	if _, exists := n.getPeer(info.Id); exists {
+		return // we're already connecting to it
+	}
+	if !info.Compatible() {
+		n.reportError(Error{
+			Kind: PROTOCOL_ERROR, PeerId: info.Id,
+			Message: fmt.Sprintf("%s runs a version of drip that's too old to talk to", info.Name)})
+		return
+	}
+
 	peer := NewPeer(
-		info.Ip, info.Id, n.port, info.Port,
-		n.ctx, n.nodeEvents, n.handlePeerMessage)
-	peer.CreateConnection()
-	peer.SetupChannels()
+		info.Ip, info.Id, n.port, info.Port, n.network,
+		n.limiter, n.ctx, n.nodeEvents, n.handlePeerMessage)
+	err := peer.CreateConnection()
+	if err == nil {
+		err = peer.SetupChannels()
+	}
+	if err != nil {
+		peer.cancel()
+		if peer.connection != nil {
+			peer.connection.Close()
+		}
+		n.reportError(Error{Kind: NETWORK_ERROR, PeerId: info.Id, Message: err.Error()})
+		return
+	}
+	peer.info = info
+	n.mu.Lock()
 	n.peers[info.Id] = peer
-	n.appEvents <- NewMessage(ADDED_PEER, info.Id)
+	n.mu.Unlock()
+	n.emit(PeerAdded{Peer: info})
+	n.checkLookAlike(info)
+}
+
+// Tear down our connection to a peer, keeping its
+// transfers around until it reconnects
+func (n *Node) removePeer(peerId string, notify bool) {
+	n.receiver.Suspend(peerId)
+	n.mu.Lock()
+	peer, exists := n.peers[peerId]
+	delete(n.peers, peerId)
+	delete(n.pairings, peerId)
+	delete(n.verified, peerId)
+	delete(n.keys, peerId)
+	n.mu.Unlock()
+	n.limiter.forget(peerId)
+
+	if exists {
+		// closing sends a REMOVED_PEER event, so it can't block this goroutine
+		go peer.Close()
+	}
+	if notify {
+		n.emit(PeerRemoved{PeerId: peerId})
+	}
 }
 
 func (n *Node) handleNodeEvents() {
 	for event := range n.nodeEvents {
 		switch event.Type {
-		case TRANSFER_RESPONSE:
-			n.sendMsg(event) // send the response to the sender
-
 		case ADDED_PEER:
 			info, err := Deserialize[PeerInfo](event)
 			if err != nil {
-				panic(err)
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
 			}
 			n.addPeer(info)
 
 		case REMOVED_PEER:
 			peerId, err := Deserialize[string](event)
 			if err != nil {
-				panic(err)
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
+			}
+			// only the connection closing on its own is handled here,
+			// since removePeer already took care of the peers we closed
+			peer, exists := n.getPeer(peerId)
+			if exists && peer.ctx.Err() != nil {
+				n.removePeer(peerId, true)
+				n.finder.Forget(peerId) // so it's added again once it's back
+			}
+
+		case UPDATED_PEER:
+			info, err := Deserialize[PeerInfo](event)
+			if err != nil {
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
 			}
-			// remove peer
-			n.receiver.Cancel(peerId)
-			delete(n.peers, peerId)
-			n.appEvents <- NewMessage(REMOVED_PEER, peerId)
+			peer, exists := n.getPeer(info.Id)
+			if !exists {
+				n.addPeer(info)
+				continue
+			}
+			// a working connection doesn't care where the signalling
+			// server moved to, but a pending one should start over there
+			if !peer.Connected() {
+				n.removePeer(info.Id, false)
+				n.addPeer(info)
+			} else {
+				n.mu.Lock()
+				renamed := peer.info.Name != info.Name
+				peer.info = info
+				n.mu.Unlock()
+				n.emit(PeerUpdated{Peer: info})
+				if renamed {
+					n.checkLookAlike(info)
+				}
+			}
+
+		case LOST_PEER:
+			peerId, err := Deserialize[string](event)
+			if err != nil {
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
+			}
+			if _, exists := n.getPeer(peerId); exists {
+				n.removePeer(peerId, true)
+			}
+
+		case NODE_ERROR:
+			peerErr, err := Deserialize[Error](event)
+			if err != nil {
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
+			}
+			n.emit(peerErr) // a peer ran into trouble
+
+		case PEER_CONNECTED:
+			peerId, err := Deserialize[string](event)
+			if err != nil {
+				log.Printf("Failed to decode a node event: %v\n", err)
+				continue
+			}
+			n.sendHello(peerId)
+			n.receiver.Resume(peerId, n.sendMsg)
 		}
 	}
 }
@@ -122,33 +513,105 @@ func (n *Node) handleNodeEvents() {
 func (n *Node) handlePeerMessage(msg Message) {
 	switch msg.Type {
 	case TRANSFER_REQUEST:
-		n.appEvents <- msg // forward this to the frontend
+		request, ok := decode[TransferRequest](n, msg)
+		if !ok {
+			return
+		}
+		answer := func(response TransferResponse) {
+			if response.Authorized {
+				n.receiver.Expect(msg.Sender, response)
+			}
+			n.sendTo(msg.Sender, TRANSFER_RESPONSE, response)
+		}
+		if !n.addRequest(request.TransferId, msg.Sender, answer) {
+			return // already asked
+		}
+		n.emit(TransferRequested{
+			TransferId: request.TransferId,
+			PeerId:     msg.Sender, // not whoever the request claims sent it
+			Message:    request.Message,
+			Files:      request.Files,
+			TotalSize:  request.TotalSize,
+			Trusted:    n.IsTrusted(msg.Sender),
+		})
+	case PAIR_REQUEST, PAIR_RESPONSE, PAIR_CONFIRM:
+		n.handlePairingMessage(msg)
+	case PEER_HELLO:
+		n.handleHello(msg)
 	case TRANSFER_RESPONSE:
-		response, err := Deserialize[TransferResponse](msg)
-		if err != nil {
-			panic(err)
+		response, ok := decode[TransferResponse](n, msg)
+		if !ok {
+			return
 		}
 		if !response.Authorized {
-			n.appEvents <- NewMessage(TRANSFER_REJECTED, "")
+			n.emit(TransferFailed{
+				TransferId: response.TransferId, PeerId: msg.Sender,
+				Rejected: true, TimedOut: response.TimedOut})
 		}
 		n.sender.HandleTransferResponse(msg.Sender, response, n.sendMsg)
 	case TRANSFER_INFO:
-		info, err := Deserialize[Transfer](msg)
-		if err != nil {
-			panic(err)
+		info, ok := decode[Transfer](n, msg)
+		if !ok {
+			return
 		}
-		n.receiver.HandleInfo(info)
+		info.Sender = msg.Sender // don't trust what the peer claims
+		n.receiver.HandleInfo(info, n.sendMsg)
 	case TRANSFER_CANCELLED:
-		id, err := Deserialize[string](msg)
-		if err != nil {
-			panic(err)
+		id, ok := decode[string](n, msg)
+		if !ok {
+			return
+		}
+		// either we're sending it and a recipient gave up on
+		// it, or we're receiving it and the sender gave up on it
+		if n.sender.HasTransfer(id) {
+			n.sender.HandleCancel(msg.Sender, id)
+		} else {
+			n.receiver.HandleCancel(msg.Sender, id)
+		}
+	case TRANSFER_PAUSE, TRANSFER_CONTINUE:
+		id, ok := decode[string](n, msg)
+		if !ok {
+			return
+		}
+		paused := msg.Type == TRANSFER_PAUSE
+		if n.sender.HasTransfer(id) {
+			n.sender.HandlePause(msg.Sender, id, paused)
+		} else {
+			n.receiver.HandlePause(msg.Sender, id, paused)
+		}
+	case TRANSFER_RESUME:
+		request, ok := decode[ResumeRequest](n, msg)
+		if !ok {
+			return
+		}
+		n.sender.HandleResume(msg.Sender, request, n.sendMsg)
+	case TRANSFER_RECEIVED:
+		id, ok := decode[string](n, msg)
+		if !ok {
+			return
+		}
+		n.sender.HandleReceived(msg.Sender, id)
+	case TRANSFER_RESEND:
+		request, ok := decode[ResendRequest](n, msg)
+		if !ok {
+			return
+		}
+		n.sender.HandleResend(msg.Sender, request, n.sendMsg)
+	case TRANSFER_INVALID:
+		rejection, ok := decode[ManifestRejection](n, msg)
+		if !ok {
+			return
 		}
-		n.receiver.HandleCancel(id)
+		n.sender.HandleRejection(msg.Sender, rejection)
+		n.emit(TransferFailed{
+			TransferId: rejection.TransferId, PeerId: msg.Sender,
+			Rejected: true, Corrupted: rejection.Corrupted, Reason: rejection.Reason})
 	case TRANSFER_CHUNK:
-		chunk, err := Deserialize[Chunk](msg)
+		chunk, err := GetChunk(msg)
 		if err != nil {
-			panic(err)
+			n.reportError(Error{Kind: PROTOCOL_ERROR, PeerId: msg.Sender, Message: err.Error()})
+			return
 		}
-		go n.receiver.HandleChunk(chunk)
+		go n.receiver.HandleChunk(chunk, n.sendMsg)
 	}
 }
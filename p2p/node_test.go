@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A node that only finds peers it's told about, so tests don't see each other
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	downloads := t.TempDir()
+	n, err := NewNode(ctx, NodeConfig{
+		DataFolder:     t.TempDir(),
+		DisplayName:    "test",
+		DownloadFolder: &downloads,
+		Network:        NetworkConfig{LanOnly: true},
+		Discovery:      DiscoveryConfig{NoMDNS: true, NoBeacon: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.Shutdown()
+		cancel()
+	})
+	return n
+}
+
+// Run something the app would call from its event loop, failing if it
+// blocks, which it would if it waited for the loop to read an event
+func withoutReading(t *testing.T, call func()) {
+	t.Helper()
+	done := make(chan bool)
+	go func() {
+		call()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked until its events were read")
+	}
+}
+
+// Wait for an event of a certain type, skipping the others
+func nextEvent[T Event](t *testing.T, n *Node) T {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-n.Events():
+			if match, ok := event.(T); ok {
+				return match
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("no %T event", zero)
+			return zero
+		}
+	}
+}
+
+func TestConfirmPairingDoesNotBlock(t *testing.T) {
+	n := newTestNode(t)
+	key, _, _ := ed25519.GenerateKey(nil)
+	peerId := DeviceIdFromKey(key)
+
+	n.mu.Lock()
+	n.pairings[peerId] = &pairing{theirKey: key, initiator: true}
+	n.mu.Unlock()
+	withoutReading(t, func() { n.ConfirmPairing(peerId, true) })
+
+	if paired := nextEvent[Paired](t, n); paired.PeerId != peerId {
+		t.Fatalf("paired with %s instead of %s", paired.PeerId, peerId)
+	}
+	if !n.IsTrusted(peerId) {
+		t.Fatal("the peer isn't trusted")
+	}
+}
+
+func TestEventsKeepTheirOrder(t *testing.T) {
+	n := newTestNode(t)
+	for i := range 100 {
+		n.emit(PeerRemoved{PeerId: string(rune('a' + i%26))})
+	}
+	for i := range 100 {
+		removed := nextEvent[PeerRemoved](t, n)
+		if removed.PeerId != string(rune('a'+i%26)) {
+			t.Fatalf("event %d came out of order", i)
+		}
+	}
+}
+
+func TestPausingDoesNotBlock(t *testing.T) {
+	n := newTestNode(t)
+	files := map[string]*File{"a": NewReaderFile("a", 0, nopReaderAt{})}
+	id := n.SendFiles([]string{"nobody"}, files)
+
+	withoutReading(t, func() { n.PauseTransfer(id) })
+	if progress := nextEvent[TransferProgress](t, n); !progress.Report.Paused {
+		t.Fatal("the transfer wasn't paused")
+	}
+	withoutReading(t, func() { n.UnpauseTransfer(id) })
+	if progress := nextEvent[TransferProgress](t, n); progress.Report.Paused {
+		t.Fatal("the transfer wasn't unpaused")
+	}
+}
+
+type nopReaderAt struct{}
+
+func (nopReaderAt) Read([]byte) (int, error)          { return 0, io.EOF }
+func (nopReaderAt) ReadAt([]byte, int64) (int, error) { return 0, io.EOF }
+func (nopReaderAt) Close() error                      { return nil }
+
+func TestScanningAConnectedPeerDoesNotBlock(t *testing.T) {
+	n := newTestNode(t)
+	key, _, _ := ed25519.GenerateKey(nil)
+	peerId := DeviceIdFromKey(key)
+
+	n.mu.Lock()
+	n.keys[peerId] = key // it already said hello
+	n.mu.Unlock()
+	payload := PairingPayload{Ip: "127.0.0.1", Port: 9, Id: peerId, Fingerprint: keyFingerprint(key)}
+	withoutReading(t, func() {
+		if err := n.AddPeerFromPayload(payload.String()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if paired := nextEvent[Paired](t, n); paired.PeerId != peerId {
+		t.Fatalf("paired with %s instead of %s", paired.PeerId, peerId)
+	}
+}
+
+// A peer we're still connecting to, that hasn't opened its data channels.
+// Its id sorts before ours, so we're the polite side and wait for them.
+func pendingPeer(t *testing.T, n *Node) PeerInfo {
+	t.Helper()
+	info := PeerInfo{Id: "0pending", Name: "pending", Ip: net.IPv4(127, 0, 0, 1), Port: 9, Version: 1}
+	n.nodeEvents <- NewMessage(ADDED_PEER, info)
+	nextEvent[PeerAdded](t, n)
+	if peer, exists := n.getPeer(info.Id); !exists || peer.Connected() {
+		t.Fatal("the peer should be pending")
+	}
+	return info
+}
+
+func TestPendingPeerCanExpire(t *testing.T) {
+	n := newTestNode(t)
+	info := pendingPeer(t, n)
+	n.nodeEvents <- NewMessage(LOST_PEER, info.Id)
+	if removed := nextEvent[PeerRemoved](t, n); removed.PeerId != info.Id {
+		t.Fatalf("removed %s instead of %s", removed.PeerId, info.Id)
+	}
+	time.Sleep(100 * time.Millisecond) // closing happens in the background
+}
+
+func TestPendingPeerCanMove(t *testing.T) {
+	n := newTestNode(t)
+	info := pendingPeer(t, n)
+	info.Port = 10
+	n.nodeEvents <- NewMessage(UPDATED_PEER, info)
+	if added := nextEvent[PeerAdded](t, n); added.Peer.Port != info.Port {
+		t.Fatalf("the peer is still at port %d", added.Peer.Port)
+	}
+	time.Sleep(100 * time.Millisecond)
+}
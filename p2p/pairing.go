@@ -0,0 +1,322 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+const ( // message types
+	PAIR_REQUEST = iota + 300
+	PAIR_RESPONSE
+	PAIR_CONFIRM
+	PEER_HELLO
+)
+
+// Pairing works like this:
+//  1. The initiator sends its public key in a PAIR_REQUEST
+//  2. The responder shows a code derived from both keys and
+//     both DTLS fingerprints, and replies with its own key
+//  3. The initiator shows the same code, and if the user says
+//     it matches, trusts the responder and sends a PAIR_CONFIRM
+//  4. The responder trusts the initiator once it gets the confirmation
+//
+// A man in the middle would have different DTLS fingerprints
+// on each side, so the codes wouldn't match.
+type PairingMessage struct {
+	PublicKey ed25519.PublicKey `json:",omitempty"`
+	Accepted  bool
+}
+
+// Sent when a connection opens to prove we own our public key
+type Hello struct {
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+// What the user needs to compare the codes on both devices
+type PairingCode struct {
+	PeerId    string
+	Code      string
+	Initiator bool
+}
+
+type pairing struct {
+	theirKey  ed25519.PublicKey
+	initiator bool
+	accepted  bool
+}
+
+// The short authentication string both devices should show
+func pairingCode(fingerprints [2]string, keys [2]ed25519.PublicKey) string {
+	if fingerprints[0] > fingerprints[1] {
+		fingerprints[0], fingerprints[1] = fingerprints[1], fingerprints[0]
+	}
+	if bytes.Compare(keys[0], keys[1]) > 0 {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte("drip-pairing"))
+	hash.Write([]byte(fingerprints[0]))
+	hash.Write([]byte(fingerprints[1]))
+	hash.Write(keys[0])
+	hash.Write(keys[1])
+	sum := hash.Sum(nil)
+
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[:4])%1000000)
+}
+
+// What a hello signs, tying our key to this specific connection
+func helloPayload(senderFingerprint string, receiverFingerprint string) []byte {
+	return []byte("drip-hello" + senderFingerprint + receiverFingerprint)
+}
+
+func (n *Node) getPeer(id string) (*PeerConnection, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer, exists := n.peers[id]
+	return peer, exists
+}
+
+func (n *Node) sendTo(peerId string, msgType int, value any) {
+	msg := NewMessage(msgType, value)
+	msg.Recipients = []string{peerId}
+	n.sendMsg(msg)
+}
+
+// Start pairing with a peer
+func (n *Node) Pair(peerId string) {
+	if n.localSend != nil && n.localSend.isDevice(peerId) {
+		n.emit(PairingFailed{PeerId: peerId}) // LocalSend has no pairing
+		return
+	}
+	n.mu.Lock()
+	peer, exists := n.peers[peerId]
+	if exists && !peer.info.Supports(PAIRING_CAPABILITY) {
+		n.mu.Unlock()
+		n.emit(PairingFailed{PeerId: peerId})
+		return
+	}
+	n.pairings[peerId] = &pairing{initiator: true}
+	n.mu.Unlock()
+	n.sendTo(peerId, PAIR_REQUEST, PairingMessage{PublicKey: n.identity.PublicKey})
+}
+
+// Relay whether the user says the pairing codes match
+func (n *Node) ConfirmPairing(peerId string, accepted bool) {
+	n.mu.Lock()
+	state, exists := n.pairings[peerId]
+	if !exists {
+		n.mu.Unlock()
+		return
+	}
+	if !accepted || state.initiator {
+		delete(n.pairings, peerId)
+	}
+	state.accepted = accepted
+	n.mu.Unlock()
+
+	if !state.initiator {
+		response := PairingMessage{PublicKey: n.identity.PublicKey, Accepted: accepted}
+		n.sendTo(peerId, PAIR_RESPONSE, response)
+		return
+	}
+
+	n.sendTo(peerId, PAIR_CONFIRM, PairingMessage{Accepted: accepted})
+	if accepted {
+		n.trustPeer(peerId, state.theirKey)
+	}
+}
+
+func (n *Node) trustPeer(peerId string, key ed25519.PublicKey) {
+	name := ""
+	if peer, exists := n.getPeer(peerId); exists {
+		n.mu.Lock()
+		name = peer.info.Name
+		n.mu.Unlock()
+	}
+	if err := n.trust.Add(peerId, name, key); err != nil {
+		log.Printf("Failed to save the trusted peers: %v\n", err)
+	}
+	n.mu.Lock()
+	n.verified[peerId] = true
+	n.mu.Unlock()
+	n.emit(Paired{PeerId: peerId})
+}
+
+// Warn about a device going by the name of one we've paired with,
+// since that's what the user goes by when picking who to send to
+func (n *Node) checkLookAlike(info PeerInfo) {
+	paired, exists := n.trust.Named(info.Name)
+	if exists && paired.Id != info.Id {
+		n.emit(PeerLookAlike{PeerId: info.Id, PairedId: paired.Id})
+	}
+}
+
+// Whether the peer proved it's a device we've paired with
+func (n *Node) IsTrusted(peerId string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.verified[peerId]
+}
+
+func (n *Node) showPairingCode(peerId string, theirKey ed25519.PublicKey, initiator bool) {
+	peer, exists := n.getPeer(peerId)
+	if !exists {
+		return
+	}
+	local, remote, err := peer.Fingerprints()
+	if err != nil {
+		log.Printf("Failed to get the fingerprints for %s: %v\n", peerId, err)
+		return
+	}
+
+	code := pairingCode([2]string{local, remote},
+		[2]ed25519.PublicKey{n.identity.PublicKey, theirKey})
+	n.emit(PairingRequested{
+		PairingCode{PeerId: peerId, Code: code, Initiator: initiator}})
+}
+
+func (n *Node) handlePairingMessage(msg Message) {
+	pm, ok := decode[PairingMessage](n, msg)
+	if !ok {
+		return
+	}
+
+	n.mu.Lock()
+	state, exists := n.pairings[msg.Sender]
+	n.mu.Unlock()
+
+	switch msg.Type {
+	case PAIR_REQUEST:
+		if len(pm.PublicKey) != ed25519.PublicKeySize {
+			return
+		}
+		n.mu.Lock()
+		n.pairings[msg.Sender] = &pairing{theirKey: pm.PublicKey}
+		n.mu.Unlock()
+		n.showPairingCode(msg.Sender, pm.PublicKey, false)
+
+	case PAIR_RESPONSE:
+		if !exists || !state.initiator {
+			return
+		}
+		if !pm.Accepted || len(pm.PublicKey) != ed25519.PublicKeySize {
+			n.mu.Lock()
+			delete(n.pairings, msg.Sender)
+			n.mu.Unlock()
+			n.emit(PairingFailed{PeerId: msg.Sender})
+			return
+		}
+		n.mu.Lock()
+		state.theirKey = pm.PublicKey
+		n.mu.Unlock()
+		n.showPairingCode(msg.Sender, pm.PublicKey, true)
+
+	case PAIR_CONFIRM:
+		if !exists || state.initiator {
+			return
+		}
+		n.mu.Lock()
+		delete(n.pairings, msg.Sender)
+		n.mu.Unlock()
+
+		if pm.Accepted && state.accepted {
+			n.trustPeer(msg.Sender, state.theirKey)
+		} else {
+			n.emit(PairingFailed{PeerId: msg.Sender})
+		}
+	}
+}
+
+// Prove who we are to a peer whose connection just opened
+func (n *Node) sendHello(peerId string) {
+	peer, exists := n.getPeer(peerId)
+	if !exists {
+		return
+	}
+	local, remote, err := peer.Fingerprints()
+	if err != nil {
+		log.Printf("Failed to get the fingerprints for %s: %v\n", peerId, err)
+		return
+	}
+
+	hello := Hello{
+		PublicKey: n.identity.PublicKey,
+		Signature: n.identity.Sign(helloPayload(local, remote)),
+	}
+	n.sendTo(peerId, PEER_HELLO, hello)
+}
+
+// Check a peer's hello against the key we paired with, if any
+func (n *Node) handleHello(msg Message) {
+	hello, ok := decode[Hello](n, msg)
+	if !ok {
+		return
+	}
+
+	peer, exists := n.getPeer(msg.Sender)
+	if !exists {
+		return
+	}
+	local, remote, err := peer.Fingerprints()
+	if err != nil {
+		log.Printf("Failed to get the fingerprints for %s: %v\n", msg.Sender, err)
+		return
+	}
+
+	if !validHello(hello, msg.Sender, local, remote) {
+		n.emit(PeerImpersonated{PeerId: msg.Sender})
+		return
+	}
+	n.mu.Lock()
+	n.keys[msg.Sender] = hello.PublicKey
+	n.mu.Unlock()
+	if n.checkScannedKey(msg.Sender, hello.PublicKey) {
+		return
+	}
+
+	paired, matches := n.trust.Check(msg.Sender, hello.PublicKey)
+	if !paired {
+		return
+	}
+
+	if matches {
+		n.mu.Lock()
+		n.verified[msg.Sender] = true
+		n.mu.Unlock()
+	} else {
+		n.emit(PeerImpersonated{PeerId: msg.Sender})
+	}
+}
+
+// Whether a hello was signed for this connection by the key the sender's id
+// was derived from. The fingerprints are ours and the sender's, in that order.
+func validHello(hello Hello, sender string, local string, remote string) bool {
+	return len(hello.PublicKey) == ed25519.PublicKeySize &&
+		DeviceIdFromKey(hello.PublicKey) == sender &&
+		ed25519.Verify(hello.PublicKey, helloPayload(remote, local), hello.Signature)
+}
+
+// Pair with a peer whose pairing code we were given, if its key is the one
+// the code describes. Returns whether there was a code to check it against.
+func (n *Node) checkScannedKey(peerId string, key ed25519.PublicKey) bool {
+	n.mu.Lock()
+	fingerprint, scanned := n.scanned[peerId]
+	delete(n.scanned, peerId)
+	n.mu.Unlock()
+	if !scanned {
+		return false
+	}
+
+	if keyFingerprint(key) == fingerprint {
+		n.trustPeer(peerId, key)
+	} else {
+		n.emit(PeerImpersonated{PeerId: peerId})
+	}
+	return true
+}
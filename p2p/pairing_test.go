@@ -0,0 +1,86 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) Identity {
+	t.Helper()
+	identity, err := LoadIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestPairingCodes(t *testing.T) {
+	a, b, c := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	ours := pairingCode([2]string{"fingerprint a", "fingerprint b"},
+		[2]ed25519.PublicKey{a.PublicKey, b.PublicKey})
+	theirs := pairingCode([2]string{"fingerprint b", "fingerprint a"},
+		[2]ed25519.PublicKey{b.PublicKey, a.PublicKey})
+	if ours != theirs {
+		t.Fatalf("the devices show %s and %s", ours, theirs)
+	}
+	if len(ours) != 6 {
+		t.Fatalf("the code %q isn't 6 digits", ours)
+	}
+
+	// someone in the middle has its own key, and its own connections
+	other := pairingCode([2]string{"fingerprint a", "fingerprint b"},
+		[2]ed25519.PublicKey{a.PublicKey, c.PublicKey})
+	if other == ours {
+		t.Error("a different key gave the same code")
+	}
+	other = pairingCode([2]string{"fingerprint a", "fingerprint m"},
+		[2]ed25519.PublicKey{a.PublicKey, b.PublicKey})
+	if other == ours {
+		t.Error("a different connection gave the same code")
+	}
+}
+
+func TestHellos(t *testing.T) {
+	peer, other := newTestIdentity(t), newTestIdentity(t)
+	// what the peer sees as local and remote, we see the other way around
+	hello := Hello{PublicKey: peer.PublicKey, Signature: peer.Sign(helloPayload("theirs", "ours"))}
+	if !validHello(hello, peer.DeviceId(), "ours", "theirs") {
+		t.Fatal("refused a valid hello")
+	}
+
+	tests := map[string]struct {
+		hello  Hello
+		sender string
+	}{
+		"someone else's id": {hello, other.DeviceId()},
+		"someone else's key": {Hello{
+			PublicKey: other.PublicKey, Signature: hello.Signature}, peer.DeviceId()},
+		"another connection": {Hello{
+			PublicKey: peer.PublicKey, Signature: peer.Sign(helloPayload("theirs", "elsewhere"))},
+			peer.DeviceId()},
+		"no key": {Hello{Signature: hello.Signature}, peer.DeviceId()},
+	}
+	for name, test := range tests {
+		if validHello(test.hello, test.sender, "ours", "theirs") {
+			t.Errorf("%s: accepted the hello", name)
+		}
+	}
+}
+
+func TestLookAlikesAreReported(t *testing.T) {
+	n := newTestNode(t)
+	laptop := newTestIdentity(t)
+	if err := n.trust.Add(laptop.DeviceId(), "laptop", laptop.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// it sorts before our id, so we wait for it to connect to us
+	info := PeerInfo{Id: "0lookalike", Name: "Laptop", Ip: net.IPv4(127, 0, 0, 1), Port: 9, Version: 1}
+	n.nodeEvents <- NewMessage(ADDED_PEER, info)
+	nextEvent[PeerAdded](t, n)
+	lookAlike := nextEvent[PeerLookAlike](t, n)
+	if lookAlike.PeerId != info.Id || lookAlike.PairedId != laptop.DeviceId() {
+		t.Fatalf("reported %+v", lookAlike)
+	}
+}
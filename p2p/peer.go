@@ -2,11 +2,12 @@ package p2p
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -15,6 +16,7 @@ type PeerConnection struct {
 	makingOffer bool
 	polite      bool
 	id          string
+	info        PeerInfo // what discovery found out about it, guarded by the node's lock
 
 	server     TcpServer
 	connection *webrtc.PeerConnection
@@ -26,14 +28,16 @@ type PeerConnection struct {
 	pendingChunks  chan Message
 	chunksChannel  *webrtc.DataChannel
 
+	network   NetworkConfig
+	limiter   *rateLimiter
 	ctx       context.Context
 	cancel    context.CancelFunc
 	closeOnce sync.Once
 }
 
 func NewPeer(
-	ip net.IP, id string, devicePort int, port int,
-	parentCtx context.Context, nodeEvents chan Message,
+	ip net.IP, id string, devicePort int, port int, network NetworkConfig,
+	limiter *rateLimiter, parentCtx context.Context, nodeEvents chan Message,
 	handler func(Message),
 ) *PeerConnection {
 	ourAddr := fmt.Sprintf(":%d", devicePort)
@@ -45,7 +49,7 @@ func NewPeer(
 	// Being impolite will mean we ignore the peer's offer and continue with
 	// our own. This way, we avoid collisions by knowing that only one peer
 	// is able to initiate a connection
-	polite := id < deviceName()
+	polite := id < deviceId()
 
 	return &PeerConnection{
 		makingOffer:    false,
@@ -54,6 +58,8 @@ func NewPeer(
 		server:         NewTcpServer(ourAddr, peerAddr, ctx),
 		pendingMesages: make(chan Message, 100),
 		pendingChunks:  make(chan Message, 100),
+		network:        network,
+		limiter:        limiter,
 		ctx:            ctx,
 		cancel:         cancel,
 		msgHandler:     handler,
@@ -65,27 +71,76 @@ func NewPeer(
 func (p *PeerConnection) Close() {
 	p.closeOnce.Do(func() {
 		p.cancel()
-		close(p.pendingChunks)
-		close(p.pendingMesages)
-		p.connection.Close()
-		p.chunksChannel.GracefulClose()
-		p.msgChannel.GracefulClose()
+		// a pending peer might not have its channels yet
+		if p.chunksChannel != nil {
+			p.chunksChannel.GracefulClose()
+		}
+		if p.msgChannel != nil {
+			p.msgChannel.GracefulClose()
+		}
+		if p.connection != nil {
+			p.connection.Close()
+		}
 		p.nodeEvents <- NewMessage(REMOVED_PEER, p.id)
 	})
 }
 
+// Queue a message to be sent, dropping it if the peer has been closed
+func (p *PeerConnection) Queue(channel chan Message, msg Message) {
+	select {
+	case <-p.ctx.Done():
+	case channel <- msg:
+	}
+}
+
 func (p *PeerConnection) Connected() bool {
 	return p.msgChannel != nil && p.chunksChannel != nil
 }
 
-func (p *PeerConnection) CreateConnection() {
-	var err error
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+// Get the DTLS certificate fingerprints of both ends of the connection
+func (p *PeerConnection) Fingerprints() (string, string, error) {
+	find := func(description *webrtc.SessionDescription) (string, error) {
+		if description == nil {
+			return "", errors.New("no session description yet")
+		}
+		for _, line := range strings.Split(description.SDP, "\n") {
+			line = strings.TrimSpace(line)
+			if fingerprint, found := strings.CutPrefix(line, "a=fingerprint:"); found {
+				return fingerprint, nil
+			}
+		}
+		return "", errors.New("no fingerprint in the session description")
+	}
+
+	local, err := find(p.connection.CurrentLocalDescription())
+	if err != nil {
+		return "", "", err
+	}
+	remote, err := find(p.connection.CurrentRemoteDescription())
+	return local, remote, err
+}
+
+// Let the node know something went wrong with this peer
+func (p *PeerConnection) reportError(kind int, err error) {
+	log.Printf("Failed to talk to %s: %v\n", p.id, err)
+	select {
+	case <-p.ctx.Done():
+	case p.nodeEvents <- NewMessage(NODE_ERROR,
+		Error{Kind: kind, PeerId: p.id, Message: err.Error()}):
 	}
-	p.connection, err = webrtc.NewPeerConnection(config)
+}
+
+// Give up on a connection that can't recover
+func (p *PeerConnection) fail(err error) {
+	p.reportError(NETWORK_ERROR, err)
+	p.Close()
+}
+
+func (p *PeerConnection) CreateConnection() error {
+	var err error
+	p.connection, err = webrtc.NewPeerConnection(p.network.webrtcConfig())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	p.connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
@@ -101,10 +156,12 @@ func (p *PeerConnection) CreateConnection() {
 		p.makingOffer = true
 		offer, err := p.connection.CreateOffer(nil)
 		if err != nil {
-			panic(err)
+			p.fail(err)
+			return
 		}
 		if err := p.connection.SetLocalDescription(offer); err != nil {
-			panic(err)
+			p.fail(err)
+			return
 		}
 
 		p.server.QueueMessage(NewMessage(OFFER_TCP_PACKET, offer))
@@ -117,38 +174,76 @@ func (p *PeerConnection) CreateConnection() {
 		p.server.QueueMessage(NewMessage(ICE_TCP_PACKET, i))
 		log.Println("Sending an ice candidate")
 	})
+	return nil
 }
 
-func (p *PeerConnection) SetupChannels() {
-	go func() { p.server.ForwardMessages() }()
-	go func() { p.server.ReceiveMessages(p.handlePeerMessage) }()
+func (p *PeerConnection) SetupChannels() error {
+	go func() {
+		if err := p.server.ForwardMessages(); err != nil {
+			p.fail(err)
+		}
+	}()
+	go func() {
+		if err := p.server.ReceiveMessages(p.handlePeerMessage); err != nil {
+			p.fail(err)
+		}
+	}()
 
 	receiveHandler := func(dataChannel *webrtc.DataChannel) {
 		dataChannel.OnMessage(func(channelMsg webrtc.DataChannelMessage) {
-			msg := GetMessage(channelMsg.Data)
-			if msg.Sender != deviceName() {
-				p.msgHandler(msg)
+			if dataChannel.Label() == "chunk" { // chunks are binary frames
+				p.msgHandler(Message{
+					Type: TRANSFER_CHUNK, Sender: p.id, Data: channelMsg.Data})
+				return
+			}
+
+			msg, err := GetMessage(channelMsg.Data)
+			if err != nil { // drop it, the rest of the connection is fine
+				p.reportError(PROTOCOL_ERROR, err)
+				return
 			}
+			msg.Sender = p.id // the connection tells us who sent it, not the peer
+			p.msgHandler(msg)
 		})
 	}
 
 	sendHandler := func(dataChannel *webrtc.DataChannel, channel chan Message) {
-		bufferSizeLimit := uint64(8 * 1024 * 1024) // 8 megabytes
-		for msg := range channel {
-			// don't keep too much data buffered in order
-			// to reduce congestion and limit memory usage
-			for dataChannel.BufferedAmount() > bufferSizeLimit {
-				time.Sleep(10 * time.Millisecond)
+		gate := newBufferGate(dataChannel, p.network)
+		for {
+			var msg Message
+			select {
+			case <-p.ctx.Done():
+				return
+			case msg = <-channel:
+			}
+
+			if !gate.wait(p.ctx) {
+				return
+			}
+			if msg.Type == TRANSFER_CHUNK {
+				if err := p.limiter.wait(p.ctx, p.id, len(msg.Data)); err != nil {
+					return // closed while waiting
+				}
+				dataChannel.Send(msg.Data)
+			} else {
+				dataChannel.Send(msg.Serialize())
 			}
-			dataChannel.Send(msg.Serialize())
 		}
 	}
 
+	// let the node know it can start talking to the peer
+	onOpen := func(dataChannel *webrtc.DataChannel) {
+		dataChannel.OnOpen(func() {
+			p.nodeEvents <- NewMessage(PEER_CONNECTED, p.id)
+		})
+	}
+
 	if p.polite {
 		p.connection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
 			if dataChannel.Label() == "message" {
 				p.msgChannel = dataChannel
 				receiveHandler(p.msgChannel)
+				onOpen(p.msgChannel)
 				go sendHandler(p.msgChannel, p.pendingMesages)
 			} else {
 				p.chunksChannel = dataChannel
@@ -162,74 +257,116 @@ func (p *PeerConnection) SetupChannels() {
 
 		p.msgChannel, err = p.connection.CreateDataChannel("message", nil)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		receiveHandler(p.msgChannel)
+		onOpen(p.msgChannel)
 		go sendHandler(p.msgChannel, p.pendingMesages)
 
 		p.chunksChannel, err = p.connection.CreateDataChannel("chunk", nil)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		receiveHandler(p.chunksChannel)
 		go sendHandler(p.chunksChannel, p.pendingChunks)
 
 		log.Println("Created control and message data channels")
 	}
+	return nil
 }
 
-func (p *PeerConnection) handleOffer(msg Message) {
+// Holds off sending on a data channel while too much is buffered, to reduce
+// congestion and limit memory usage. Once the buffer fills up, it waits for
+// pion to say it has drained rather than checking over and over.
+type bufferGate struct {
+	channel *webrtc.DataChannel
+	high    uint64
+	drained chan struct{}
+}
+
+func newBufferGate(channel *webrtc.DataChannel, network NetworkConfig) *bufferGate {
+	high, low := network.bufferThresholds()
+	gate := &bufferGate{channel: channel, high: high, drained: make(chan struct{}, 1)}
+	channel.SetBufferedAmountLowThreshold(low)
+	channel.OnBufferedAmountLow(func() {
+		select {
+		case gate.drained <- struct{}{}:
+		default: // already woken up
+		}
+	})
+	return gate
+}
+
+// Wait until there's room to send, returning false if ctx is cancelled first
+func (g *bufferGate) wait(ctx context.Context) bool {
+	for g.channel.BufferedAmount() > g.high {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-g.drained:
+		}
+	}
+	return true
+}
+
+func (p *PeerConnection) handleOffer(msg Message) error {
 	// are we getting an offer in the middle of sending ours?
 	negotiating := p.connection.SignalingState() != webrtc.SignalingStateStable
 	offerCollision := negotiating || p.makingOffer
 
 	if offerCollision && !p.polite {
-		return // Ignore the peer's offer and so we can move forward with our own
+		return nil // Ignore the peer's offer and so we can move forward with our own
 	}
 	p.makingOffer = false
 
 	offer, err := Deserialize[webrtc.SessionDescription](msg)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if err := p.connection.SetRemoteDescription(offer); err != nil {
-		panic(err)
+		return err
 	}
 
 	answer, err := p.connection.CreateAnswer(nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if err := p.connection.SetLocalDescription(answer); err != nil {
-		panic(err)
+		return err
 	}
 	p.server.QueueMessage(NewMessage(ANSWER_TCP_PACKET, answer))
 	log.Println("Accepting an offer")
+	return nil
 }
 
-func (p *PeerConnection) handlePeerMessage(msg Message) {
+func (p *PeerConnection) handlePeerMessage(msg Message) error {
 	switch msg.Type {
 	case ANSWER_TCP_PACKET:
 		answer, err := Deserialize[webrtc.SessionDescription](msg)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		p.connection.SetRemoteDescription(answer)
 		log.Println("Accepting an answer")
+		return p.connection.SetRemoteDescription(answer)
 
 	case ICE_TCP_PACKET:
 		candidate, err := Deserialize[webrtc.ICECandidate](msg)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		// a bad candidate isn't worth dropping the connection over
+		if err := p.connection.AddICECandidate(candidate.ToJSON()); err != nil {
+			log.Printf("Failed to add an ICE candidate: %v\n", err)
+		} else {
+			log.Println("Adding an ICE candidate")
 		}
-		p.connection.AddICECandidate(candidate.ToJSON())
-		log.Println("Adding an ICE candidate")
+		return nil
 
 	case OFFER_TCP_PACKET:
-		p.handleOffer(msg)
+		return p.handleOffer(msg)
 
 	default:
-		panic("uknown signal type")
+		return fmt.Errorf("unknown signal type %d", msg.Type)
 	}
 }
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Find a port nobody's listening on
+func freePort(b *testing.B) int {
+	b.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Connect two of our peer connections to each other in the same process,
+// signalling over loopback like two nodes would. Returns the side that sends
+// chunks, and a count of the chunk bytes that arrived on the other side.
+func loopbackPeers(b *testing.B) (*PeerConnection, *atomic.Int64) {
+	b.Helper()
+	// whether a peer is polite depends on our id, which both sides share here
+	previous := deviceId()
+	localDeviceId.Store("m")
+	b.Cleanup(func() { localDeviceId.Store(previous) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Message, 16)
+	connected := make(chan struct{}, 2)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if event.Type == PEER_CONNECTED {
+					connected <- struct{}{}
+				}
+			}
+		}
+	}()
+
+	received := &atomic.Int64{}
+	onMessage := func(msg Message) {
+		if msg.Type == TRANSFER_CHUNK {
+			received.Add(int64(len(msg.Data)))
+		}
+	}
+	limiter := newRateLimiter(RateLimits{})
+	network := NetworkConfig{LanOnly: true}
+	loopback := net.IPv4(127, 0, 0, 1)
+	senderPort, receiverPort := freePort(b), freePort(b)
+
+	// the sender is impolite, so it opens the data channels
+	sender := NewPeer(loopback, "zreceiver", senderPort, receiverPort,
+		network, limiter, ctx, events, func(Message) {})
+	receiver := NewPeer(loopback, "0sender", receiverPort, senderPort,
+		network, limiter, ctx, events, onMessage)
+	b.Cleanup(func() {
+		// closing tells the node, so keep reading events until then
+		sender.Close()
+		receiver.Close()
+		cancel()
+	})
+	for _, peer := range []*PeerConnection{receiver, sender} {
+		if err := peer.CreateConnection(); err != nil {
+			b.Fatal(err)
+		}
+		if err := peer.SetupChannels(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	timeout := time.After(10 * time.Second)
+	for range 2 {
+		select {
+		case <-connected:
+		case <-timeout:
+			b.Fatal("the peers never connected")
+		}
+	}
+	for sender.chunksChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		select {
+		case <-timeout:
+			b.Fatal("the chunk channel never opened")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return sender, received
+}
+
+// Send chunks through the same queue, buffer gate and rate limiter that
+// transfers go through, reporting how much cpu time each chunk took
+func BenchmarkPeerSend(b *testing.B) {
+	sender, received := loopbackPeers(b)
+	data := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	cpuBefore := cpuTime()
+
+	for range b.N {
+		sender.Queue(sender.pendingChunks, Message{Type: TRANSFER_CHUNK, Data: data})
+	}
+	for received.Load() < int64(b.N)*chunkSize {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.StopTimer()
+	if cpu := cpuTime() - cpuBefore; cpu > 0 {
+		b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/op")
+	}
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	thumbnailSize      = 96       // pixels on the longest side
+	maxThumbnails      = 12       // keeps the request small
+	maxThumbnailSource = 20 << 20 // bigger images take too long to decode
+)
+
+// What the recipient is shown about a file before it accepts a transfer
+type FilePreview struct {
+	Name      string
+	Size      int64
+	Kind      int
+	MimeType  string `json:",omitempty"`
+	Thumbnail []byte `json:",omitempty"` // a small jpeg, only set for some images
+}
+
+// Describe the files of a transfer, sorted by name
+func previewFiles(files map[string]*File) ([]FilePreview, int64) {
+	previews := []FilePreview{}
+	total := int64(0)
+	thumbnails := 0
+
+	for name, f := range files {
+		p := FilePreview{Name: name, Kind: f.Kind}
+		if f.Kind == REGULAR_FILE {
+			p.Size = f.Size
+			p.MimeType = f.mimeType()
+			total += f.Size
+		}
+		if thumbnails < maxThumbnails && strings.HasPrefix(p.MimeType, "image/") {
+			p.Thumbnail = f.thumbnail()
+			if p.Thumbnail != nil {
+				thumbnails++
+			}
+		}
+		previews = append(previews, p)
+	}
+
+	slices.SortFunc(previews, func(a, b FilePreview) int { return cmp.Compare(a.Name, b.Name) })
+	return previews, total
+}
+
+// Get random access to the file if that doesn't mean spooling it first
+func (f *File) peek() (io.ReaderAt, func(), bool) {
+	if _, seekable := f.reader.(io.ReaderAt); !seekable && f.sourcePath == "" {
+		return nil, nil, false
+	}
+	reader, release, err := f.openReader()
+	return reader, release, err == nil
+}
+
+func (f *File) mimeType() string {
+	if t := mime.TypeByExtension(path.Ext(f.Name)); t != "" {
+		return t
+	}
+
+	// look at the start of the file instead
+	reader, release, ok := f.peek()
+	if !ok {
+		return ""
+	}
+	defer release()
+	header := make([]byte, 512)
+	n, _ := reader.ReadAt(header, 0)
+	if n == 0 {
+		return ""
+	}
+	return http.DetectContentType(header[:n])
+}
+
+func (f *File) thumbnail() []byte {
+	if f.Size > maxThumbnailSource {
+		return nil
+	}
+	reader, release, ok := f.peek()
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	img, _, err := image.Decode(io.NewSectionReader(reader, 0, f.Size))
+	if err != nil {
+		return nil // not an image we can decode, which is fine
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, shrink(img, thumbnailSize), &jpeg.Options{Quality: 70}); err != nil {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// Decode the thumbnail a peer sent. It only decodes small jpegs,
+// since a tiny file can describe an image that's huge once decoded.
+func (p FilePreview) DecodeThumbnail() (image.Image, error) {
+	reader := bytes.NewReader(p.Thumbnail)
+	config, err := jpeg.DecodeConfig(reader)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > thumbnailSize || config.Height > thumbnailSize {
+		return nil, errors.New("the thumbnail is too big")
+	}
+	reader.Seek(0, io.SeekStart)
+	return jpeg.Decode(reader)
+}
+
+// Scale an image down so that its longest side is at most size pixels
+func shrink(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	scale := float64(size) / float64(max(bounds.Dx(), bounds.Dy()))
+	if scale >= 1 {
+		return img
+	}
+
+	width := max(1, int(float64(bounds.Dx())*scale))
+	height := max(1, int(float64(bounds.Dy())*scale))
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			sx := bounds.Min.X + int(float64(x)/scale)
+			sy := bounds.Min.Y + int(float64(y)/scale)
+			small.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return small
+}
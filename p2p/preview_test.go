@@ -0,0 +1,34 @@
+package p2p
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func encodeJpeg(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	small := FilePreview{Thumbnail: encodeJpeg(t, thumbnailSize, 40)}
+	if img, err := small.DecodeThumbnail(); err != nil || img.Bounds().Dx() != thumbnailSize {
+		t.Fatalf("didn't decode a thumbnail that fits: %v", err)
+	}
+
+	big := FilePreview{Thumbnail: encodeJpeg(t, 40, thumbnailSize+1)}
+	if _, err := big.DecodeThumbnail(); err == nil {
+		t.Fatal("decoded a thumbnail that's too big")
+	}
+
+	notJpeg := FilePreview{Thumbnail: []byte("\x89PNG\r\n\x1a\n")}
+	if _, err := notJpeg.DecodeThumbnail(); err == nil {
+		t.Fatal("decoded a thumbnail that isn't a jpeg")
+	}
+}
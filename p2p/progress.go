@@ -0,0 +1,240 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How often progress events are sent for a transfer
+const progressInterval = 500 * time.Millisecond
+
+// How far along a file, a recipient or a whole transfer is
+type Progress struct {
+	BytesDone  int64
+	BytesTotal int64
+	Throughput float64       // bytes per second
+	ETA        time.Duration // zero when it can't be estimated yet
+}
+
+func (p Progress) Fraction() float32 {
+	if p.BytesTotal == 0 {
+		return 1
+	}
+	return float32(float64(p.BytesDone) / float64(p.BytesTotal))
+}
+
+// Something like "2.1 MB", the way sizes and speeds are shown everywhere
+func FormatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+type ProgressReport struct {
+	Progress                                // the transfer as a whole
+	Files      map[string]Progress          // keyed by the names in Transfer.Files
+	Recipients map[string]RecipientProgress // only set when sending
+	Started    bool
+	Done       bool
+
+	Paused       bool // by us
+	PausedByPeer bool // by the sender, when we're receiving
+}
+
+// How far along sending to one recipient is
+type RecipientProgress struct {
+	Progress
+	State  int // one of the RECIPIENT_* states
+	Files  map[string]Progress
+	Paused bool // by the recipient
+}
+
+// Estimates throughput with an exponential moving average
+// so the numbers don't jump around with every chunk
+type rateMeter struct {
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64
+}
+
+func (m *rateMeter) update(bytes int64, now time.Time) float64 {
+	if m.lastTime.IsZero() {
+		m.lastBytes, m.lastTime = bytes, now
+		return 0
+	}
+	elapsed := now.Sub(m.lastTime).Seconds()
+	if elapsed <= 0 {
+		return m.rate
+	}
+
+	current := float64(bytes-m.lastBytes) / elapsed
+	if m.rate == 0 {
+		m.rate = current
+	} else {
+		m.rate = 0.3*current + 0.7*m.rate
+	}
+	m.lastBytes, m.lastTime = bytes, now
+	return m.rate
+}
+
+func (m *rateMeter) progress(done int64, total int64, now time.Time) Progress {
+	p := Progress{BytesDone: done, BytesTotal: total, Throughput: m.update(done, now)}
+	if p.Throughput > 0 && done < total {
+		seconds := float64(total-done) / p.Throughput
+		p.ETA = time.Duration(seconds * float64(time.Second))
+	}
+	return p
+}
+
+type progressTracker struct {
+	meters     map[string]*rateMeter       // "" is the whole transfer
+	sent       map[string]map[string]int64 // recipient -> file name -> bytes sent
+	lastReport time.Time
+	mu         sync.Mutex
+}
+
+func (p *progressTracker) meter(key string) *rateMeter {
+	if p.meters == nil {
+		p.meters = make(map[string]*rateMeter)
+	}
+	m, exists := p.meters[key]
+	if !exists {
+		m = &rateMeter{}
+		p.meters[key] = m
+	}
+	return m
+}
+
+// Record a chunk of a file sent to a recipient
+func (t *Transfer) recordSent(f *File, recipient string, n int64) {
+	t.progress.mu.Lock()
+	defer t.progress.mu.Unlock()
+	if t.progress.sent == nil {
+		t.progress.sent = make(map[string]map[string]int64)
+	}
+	if t.progress.sent[recipient] == nil {
+		t.progress.sent[recipient] = make(map[string]int64)
+	}
+	t.progress.sent[recipient][f.Name] += n
+}
+
+// How many bytes of each file have to be sent or received
+func fileSizes(files map[string]*File) map[string]int64 {
+	sizes := make(map[string]int64)
+	for name, f := range files {
+		if f.Kind == REGULAR_FILE {
+			sizes[name] = f.Size
+		} else {
+			sizes[name] = 0
+		}
+	}
+	return sizes
+}
+
+// Work out how far along each file is from how much of it is done. Must hold progress.mu.
+func (t *Transfer) measure(
+	key string, filesDone map[string]int64, sizes map[string]int64, now time.Time) (Progress, map[string]Progress) {
+	files := make(map[string]Progress)
+	var done, total int64
+	for name, size := range sizes {
+		fileDone := min(filesDone[name], size)
+		files[name] = t.progress.meter(key+"file:"+name).progress(fileDone, size, now)
+		done += fileDone
+		total += size
+	}
+	return t.progress.meter(key).progress(done, total, now), files
+}
+
+// Must hold progress.mu
+func (t *Transfer) receivedReport(now time.Time) ProgressReport {
+	filesDone := make(map[string]int64)
+	for name, f := range t.Files {
+		if f.doneReceiving {
+			filesDone[name] = f.Size
+			continue
+		}
+		for _, r := range f.received {
+			filesDone[name] += r.End - r.Start
+		}
+	}
+
+	report := ProgressReport{}
+	report.Progress, report.Files = t.measure("", filesDone, fileSizes(t.Files), now)
+	report.Started = report.BytesDone > 0 || report.BytesTotal == 0
+	report.Done = report.BytesDone == report.BytesTotal
+	report.Paused, report.PausedByPeer = t.pause.here, t.pause.there
+	return report
+}
+
+// The transfer as a whole only counts the recipients that
+// haven't dropped out of it. Must hold progress.mu.
+func (t *Transfer) sentReport(now time.Time) ProgressReport {
+	report := ProgressReport{Recipients: make(map[string]RecipientProgress)}
+	filesDone := make(map[string]int64)
+	sizes := make(map[string]int64)
+	remaining := 0
+	report.Done = true
+	pauses := t.deliveries.pauses()
+
+	for recipient, state := range t.deliveries.snapshot() {
+		sent := t.progress.sent[recipient]
+		accepted := fileSizes(t.filesFor(recipient))
+		p := RecipientProgress{State: state, Paused: pauses[recipient].there}
+		report.Paused = report.Paused || pauses[recipient].here
+		p.Progress, p.Files = t.measure("peer:"+recipient+"/", sent, accepted, now)
+		report.Recipients[recipient] = p
+
+		if dropped(state) {
+			continue
+		}
+		remaining++
+		for name, size := range accepted {
+			sizes[name] += size
+			filesDone[name] += sent[name]
+		}
+		done := state == RECIPIENT_DONE || state == RECIPIENT_DELIVERED
+		report.Started = report.Started || state == RECIPIENT_SENDING || done
+		report.Done = report.Done && done
+	}
+
+	report.Progress, report.Files = t.measure("", filesDone, sizes, now)
+	report.Done = report.Done && remaining > 0
+	return report
+}
+
+// Send a progress event, at most once every progressInterval unless forced
+func (t *Transfer) reportProgress(sending bool, force bool) {
+	if t.emit == nil {
+		return
+	}
+
+	t.progress.mu.Lock()
+	now := time.Now()
+	if !force && now.Sub(t.progress.lastReport) < progressInterval {
+		t.progress.mu.Unlock()
+		return
+	}
+	t.progress.lastReport = now
+
+	var report ProgressReport
+	if sending {
+		report = t.sentReport(now)
+	} else {
+		report = t.receivedReport(now)
+	}
+	t.progress.mu.Unlock()
+
+	event := TransferProgress{TransferId: t.Id, Sending: sending, Report: report}
+	if !sending {
+		event.PeerId = t.Sender
+	}
+	t.emit(event)
+}
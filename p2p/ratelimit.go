@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How fast chunks may be sent, in bytes per second. 0 means no limit.
+type RateLimits struct {
+	Global   int64 // shared by every peer
+	PerPeer  int64
+	Schedule []ScheduleRule // the first rule that applies replaces the limits above
+}
+
+// Limits that only apply at certain times, like during working hours
+type ScheduleRule struct {
+	Days    []time.Weekday // every day if empty
+	Start   int            // minutes after midnight
+	End     int            // can be before Start to wrap past midnight
+	Global  int64
+	PerPeer int64
+}
+
+func (r ScheduleRule) applies(now time.Time) bool {
+	if len(r.Days) > 0 && !slices.Contains(r.Days, now.Weekday()) {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if r.Start <= r.End {
+		return minute >= r.Start && minute < r.End
+	}
+	return minute >= r.Start || minute < r.End
+}
+
+// The limits that apply right now
+func (l RateLimits) at(now time.Time) (int64, int64) {
+	for _, rule := range l.Schedule {
+		if rule.applies(now) {
+			return rule.Global, rule.PerPeer
+		}
+	}
+	return l.Global, l.PerPeer
+}
+
+type tokenBucket struct {
+	rate   float64 // tokens per second, 0 for no limit
+	tokens float64 // can go negative when a chunk is bigger than what's available
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	if float64(rate) != b.rate {
+		b.rate = float64(rate)
+		b.tokens = min(b.tokens, b.burst())
+	}
+}
+
+// Up to a second's worth of tokens can build up, but always enough for a chunk
+func (b *tokenBucket) burst() float64 { return max(b.rate, chunkSize) }
+
+// Take n tokens, returning how long to wait before using them
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		b.last = now
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.burst()
+	} else {
+		b.tokens = min(b.burst(), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Keeps chunks from being sent faster than the configured limits
+type rateLimiter struct {
+	limits RateLimits
+	global tokenBucket
+	peers  map[string]*tokenBucket
+	now    func() time.Time // swapped out to control time
+	mu     sync.Mutex
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{limits: limits, peers: make(map[string]*tokenBucket), now: time.Now}
+}
+
+func (l *rateLimiter) setLimits(limits RateLimits) {
+	l.mu.Lock()
+	l.limits = limits
+	l.mu.Unlock()
+}
+
+// Wait until n bytes can be sent to a peer
+func (l *rateLimiter) wait(ctx context.Context, peerId string, n int) error {
+	l.mu.Lock()
+	now := l.now()
+	global, perPeer := l.limits.at(now)
+	peer, exists := l.peers[peerId]
+	if !exists {
+		peer = &tokenBucket{}
+		l.peers[peerId] = peer
+	}
+	l.global.setRate(global)
+	peer.setRate(perPeer)
+	delay := max(l.global.reserve(n, now), peer.reserve(n, now))
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *rateLimiter) forget(peerId string) {
+	l.mu.Lock()
+	delete(l.peers, peerId)
+	l.mu.Unlock()
+}
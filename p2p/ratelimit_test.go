@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// what happens when taking a chunk's worth of tokens after waiting a while
+	type step struct {
+		wait time.Duration
+		want time.Duration // how long the chunk has to wait
+	}
+	tests := map[string]struct {
+		rate  int64
+		steps []step
+	}{
+		"unlimited":      {0, []step{{}, {}, {}}},
+		"starts full":    {2 * chunkSize, []step{{}, {}}},
+		"empty":          {2 * chunkSize, []step{{}, {}, {want: time.Second / 2}}},
+		"refills":        {2 * chunkSize, []step{{}, {}, {wait: time.Second / 2}}},
+		"partly refills": {2 * chunkSize, []step{{}, {}, {wait: time.Second / 4, want: time.Second / 4}}},
+		"bursts are capped": {2 * chunkSize, []step{
+			{}, {}, {wait: time.Hour}, {}, {want: time.Second / 2}}},
+		"always fits a chunk": {chunkSize / 2, []step{{}, {want: 2 * time.Second}}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{current: time.Unix(1000, 0)}
+			bucket := &tokenBucket{}
+			bucket.setRate(test.rate)
+			for i, s := range test.steps {
+				clock.advance(s.wait)
+				if got := bucket.reserve(chunkSize, clock.now()); got != s.want {
+					t.Fatalf("step %d: waited %v instead of %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleRule(t *testing.T) {
+	// 2024-01-06 was a saturday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.Local)
+	}
+	workHours := ScheduleRule{Start: 9 * 60, End: 17 * 60}
+	weekends := ScheduleRule{Days: []time.Weekday{time.Saturday, time.Sunday}, End: 24 * 60}
+	overnight := ScheduleRule{Start: 22 * 60, End: 6 * 60}
+
+	tests := map[string]struct {
+		rule ScheduleRule
+		now  time.Time
+		want bool
+	}{
+		"during the day":        {workHours, at(8, 12, 0), true},
+		"when it starts":        {workHours, at(8, 9, 0), true},
+		"when it ends":          {workHours, at(8, 17, 0), false},
+		"before it starts":      {workHours, at(8, 8, 59), false},
+		"on the right day":      {weekends, at(6, 12, 0), true},
+		"on the wrong day":      {weekends, at(8, 12, 0), false},
+		"before midnight":       {overnight, at(8, 23, 0), true},
+		"after midnight":        {overnight, at(9, 5, 59), true},
+		"after it wraps around": {overnight, at(9, 6, 0), false},
+		"before it wraps":       {overnight, at(8, 21, 59), false},
+	}
+	for name, test := range tests {
+		if got := test.rule.applies(test.now); got != test.want {
+			t.Errorf("%s: applies at %v is %v", name, test.now, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limited := RateLimits{
+		Schedule: []ScheduleRule{{Start: 9 * 60, End: 17 * 60, Global: chunkSize}}}
+	tests := map[string]struct {
+		limits RateLimits
+		sends  []string // the peer each chunk goes to
+		want   []bool   // whether each chunk went out without waiting
+	}{
+		"unlimited": {RateLimits{}, []string{"a", "a", "a"}, []bool{true, true, true}},
+		"per peer": {RateLimits{PerPeer: 2 * chunkSize},
+			[]string{"a", "a", "a", "b", "b"}, []bool{true, true, false, true, true}},
+		"global": {RateLimits{Global: 2 * chunkSize},
+			[]string{"a", "b", "c"}, []bool{true, true, false}},
+		"scheduled": {limited, []string{"a", "b"}, []bool{true, false}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{current: time.Date(2024, time.January, 8, 12, 0, 0, 0, time.Local)}
+			limiter := newRateLimiter(test.limits)
+			limiter.now = clock.now
+			for i, peer := range test.sends {
+				if got := sendsRightAway(limiter, peer); got != test.want[i] {
+					t.Fatalf("chunk %d to %s went out right away: %v", i, peer, got)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleEnding(t *testing.T) {
+	clock := &fakeClock{current: time.Date(2024, time.January, 8, 16, 59, 0, 0, time.Local)}
+	limiter := newRateLimiter(RateLimits{
+		Schedule: []ScheduleRule{{Start: 9 * 60, End: 17 * 60, Global: chunkSize}}})
+	limiter.now = clock.now
+	if !sendsRightAway(limiter, "a") || sendsRightAway(limiter, "a") {
+		t.Fatal("the scheduled limit wasn't applied")
+	}
+	clock.advance(time.Minute)
+	for range 3 {
+		if !sendsRightAway(limiter, "a") {
+			t.Fatal("still limited once the schedule ended")
+		}
+	}
+}
+
+// Whether a chunk can be sent without waiting. It can't
+// wait, since the context it's waiting on is already done.
+func sendsRightAway(limiter *rateLimiter, peer string) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return limiter.wait(ctx, peer, chunkSize) == nil
+}
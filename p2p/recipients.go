@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+)
+
+const ( // recipient states
+	RECIPIENT_PENDING  = iota // hasn't answered the request yet
+	RECIPIENT_ACCEPTED        // waiting for the files to be hashed
+	RECIPIENT_REJECTED
+	RECIPIENT_SENDING
+	RECIPIENT_DONE
+	RECIPIENT_DELIVERED // told us it has every file
+	RECIPIENT_FAILED
+	RECIPIENT_CANCELLED // stopped the transfer partway through
+)
+
+// The states a recipient can move to from each state. Rejected and failed
+// recipients have dropped out of the transfer for good, delivered ones are done with it.
+var recipientTransitions = map[int][]int{
+	RECIPIENT_PENDING:  {RECIPIENT_ACCEPTED, RECIPIENT_REJECTED, RECIPIENT_FAILED},
+	RECIPIENT_ACCEPTED: {RECIPIENT_SENDING, RECIPIENT_FAILED, RECIPIENT_CANCELLED},
+	RECIPIENT_SENDING: {
+		RECIPIENT_SENDING, RECIPIENT_DONE, RECIPIENT_DELIVERED,
+		RECIPIENT_FAILED, RECIPIENT_CANCELLED,
+	},
+	// resending what got lost
+	RECIPIENT_DONE: {RECIPIENT_SENDING, RECIPIENT_DELIVERED, RECIPIENT_FAILED},
+}
+
+type recipientState struct {
+	state  int
+	files  map[string]bool // the files it accepted, nil if it wants them all
+	ctx    context.Context // cancelled once the recipient drops out
+	cancel context.CancelFunc
+
+	pause    pauseState
+	unpaused chan struct{} // closed once it's unpaused, nil when it isn't paused
+}
+
+// Who paused a transfer. It only keeps going once neither side has it paused.
+type pauseState struct {
+	here  bool // paused by us
+	there bool // paused by the other side
+}
+
+func (p pauseState) paused() bool { return p.here || p.there }
+
+// Tracks each recipient of a transfer on its own, so one
+// recipient being slow or saying no doesn't hold up the others
+type recipientTable struct {
+	states map[string]*recipientState
+	mu     sync.Mutex
+}
+
+func newRecipientTable(recipients []string) *recipientTable {
+	table := &recipientTable{states: make(map[string]*recipientState)}
+	for _, id := range recipients {
+		ctx, cancel := context.WithCancel(context.Background())
+		table.states[id] = &recipientState{state: RECIPIENT_PENDING, ctx: ctx, cancel: cancel}
+	}
+	return table
+}
+
+// Move a recipient to a new state, returning false if it can't get there from where it is
+func (r *recipientTable) transition(recipient string, state int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.move(recipient, state)
+}
+
+// Must hold mu
+func (r *recipientTable) move(recipient string, state int) bool {
+	s, exists := r.states[recipient]
+	if !exists {
+		return false
+	}
+	for _, next := range recipientTransitions[s.state] {
+		if next == state {
+			s.state = state
+			if dropped(state) {
+				s.cancel()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Record that a recipient accepted some of the files, or all of them if files is empty
+func (r *recipientTable) accept(recipient string, files []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.move(recipient, RECIPIENT_ACCEPTED) {
+		return false
+	}
+	if len(files) == 0 {
+		return true
+	}
+
+	accepted := make(map[string]bool)
+	for _, name := range files {
+		accepted[name] = true
+	}
+	r.states[recipient].files = accepted
+	return true
+}
+
+func (r *recipientTable) acceptedFiles(recipient string) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, exists := r.states[recipient]; exists {
+		return s.files
+	}
+	return nil
+}
+
+// Pause or unpause sending to a recipient, either on our side or on
+// the recipient's. Returns false if that doesn't change anything.
+func (r *recipientTable) setPaused(recipient string, byRecipient bool, paused bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, exists := r.states[recipient]
+	if !exists {
+		return false
+	}
+
+	before := s.pause
+	if byRecipient {
+		s.pause.there = paused
+	} else {
+		s.pause.here = paused
+	}
+	if !before.paused() && s.pause.paused() {
+		s.unpaused = make(chan struct{})
+	} else if before.paused() && !s.pause.paused() {
+		close(s.unpaused)
+		s.unpaused = nil
+	}
+	return before != s.pause
+}
+
+// Pause or unpause sending to every recipient on our side
+func (r *recipientTable) pauseAll(paused bool) bool {
+	changed := false
+	for _, recipient := range r.ids() {
+		changed = r.setPaused(recipient, false, paused) || changed
+	}
+	return changed
+}
+
+// A channel that's closed once sending to the recipient is unpaused, nil if it isn't paused
+func (r *recipientTable) pauseGate(recipient string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, exists := r.states[recipient]; exists {
+		return s.unpaused
+	}
+	return nil
+}
+
+func (r *recipientTable) pauses() map[string]pauseState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pauses := make(map[string]pauseState)
+	for id, s := range r.states {
+		pauses[id] = s.pause
+	}
+	return pauses
+}
+
+func (r *recipientTable) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Collect(maps.Keys(r.states))
+}
+
+func (r *recipientTable) context(recipient string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, exists := r.states[recipient]; exists {
+		return s.ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func (r *recipientTable) snapshot() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make(map[string]int)
+	for id, s := range r.states {
+		states[id] = s.state
+	}
+	return states
+}
+
+// Whether every recipient has either dropped out or gotten the files
+func (r *recipientTable) allFinished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.states {
+		if !dropped(s.state) && s.state != RECIPIENT_DELIVERED {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *recipientTable) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.states {
+		s.cancel()
+	}
+}
+
+func dropped(state int) bool {
+	return state == RECIPIENT_REJECTED || state == RECIPIENT_FAILED ||
+		state == RECIPIENT_CANCELLED
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	maxPathLength = 4096 // bytes
+	maxNameLength = 255  // bytes, for each path component
+)
+
+// names windows won't let us create, regardless of the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sent back to the sender when we refuse to write the files it described
+type ManifestRejection struct {
+	TransferId string
+	Reason     string
+	Corrupted  bool // the files arrived, but didn't match their checksums
+}
+
+// Turn a path that came from a peer into one that's safe to create
+// inside the download folder. Paths that try to escape it are rejected.
+func sanitizePath(name string) (string, error) {
+	name = norm.NFC.String(strings.ReplaceAll(name, "\\", "/"))
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("%q is an absolute path", name)
+	}
+
+	components := []string{}
+	for _, component := range strings.Split(name, "/") {
+		component = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) || r == unicode.ReplacementChar {
+				return -1
+			}
+			return r
+		}, component)
+
+		if component == ".." {
+			return "", fmt.Errorf("%q leaves the download folder", name)
+		}
+		if component == "" || component == "." {
+			continue
+		}
+
+		// windows silently drops trailing dots and spaces
+		component = strings.TrimRight(component, ". ")
+		if component == "" {
+			return "", fmt.Errorf("%q has an invalid component", name)
+		}
+
+		stem := strings.ToUpper(strings.SplitN(component, ".", 2)[0])
+		if reservedNames[stem] {
+			component = "_" + component
+		}
+
+		if len(component) > maxNameLength {
+			return "", fmt.Errorf("%q has a component that's too long", name)
+		}
+		components = append(components, component)
+	}
+
+	if len(components) == 0 {
+		return "", errors.New("empty file name")
+	}
+	cleaned := strings.Join(components, "/")
+	if len(cleaned) > maxPathLength {
+		return "", fmt.Errorf("%q is too long", name)
+	}
+	return cleaned, nil
+}
+
+// Check everything in a manifest from a peer before anything touches the disk.
+// The files get their sanitised names, the map stays keyed by the sender's names.
+func validateManifest(t *Transfer) error {
+	if _, err := uuid.Parse(t.Id); err != nil {
+		return errors.New("invalid transfer id")
+	}
+
+	names := make(map[string]bool)
+	indexes := make(map[uint32]bool)
+	for key, f := range t.Files {
+		if f == nil {
+			return errors.New("missing file entry")
+		}
+
+		name, err := sanitizePath(key)
+		if err != nil {
+			return err
+		}
+
+		folded := strings.ToLower(name) // for case insensitive filesystems
+		if names[folded] {
+			return fmt.Errorf("%q appears more than once", name)
+		}
+		names[folded] = true
+
+		if indexes[f.Index] {
+			return fmt.Errorf("file index %d is used more than once", f.Index)
+		}
+		indexes[f.Index] = true
+
+		if f.Kind != REGULAR_FILE && f.Kind != DIRECTORY && f.Kind != SYMLINK {
+			return fmt.Errorf("%q has an unknown kind", name)
+		}
+		if f.Size < 0 || (f.Kind != REGULAR_FILE && f.Size != 0) {
+			return fmt.Errorf("%q has an invalid size", name)
+		}
+		if f.Kind == REGULAR_FILE &&
+			int64(len(f.ChunkHashes)) != (f.Size+chunkSize-1)/chunkSize {
+			return fmt.Errorf("%q has the wrong number of chunk hashes", name)
+		}
+		f.Mode = f.Mode.Perm() // never setuid, setgid or sticky
+		f.Name = name
+	}
+	return nil
+}
@@ -71,7 +71,7 @@ func readFramedMessage(conn net.Conn) ([]byte, error) {
 	return body, nil
 }
 
-func (t *TcpServer) ForwardMessages() {
+func (t *TcpServer) ForwardMessages() error {
 	var conn net.Conn
 	var err error
 
@@ -81,7 +81,7 @@ dialoop:
 		select {
 		case <-t.ctx.Done():
 			t.Close()
-			return // quit
+			return nil // quit
 		default:
 			conn, err = net.Dial("tcp", t.peerAddr)
 			if err == nil {
@@ -97,64 +97,74 @@ dialoop:
 		select {
 		case <-t.ctx.Done():
 			t.Close()
-			return // quit
+			return nil // quit
 		case pkt, ok := <-t.packets:
 			if !ok {
-				return
+				return nil
 			}
-			err := sendFramedMessage(conn, pkt)
-			if err != nil {
-				panic(err)
+			if err := sendFramedMessage(conn, pkt); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (t *TcpServer) handleConnection(conn net.Conn, handler func(Message)) {
+func (t *TcpServer) handleConnection(conn net.Conn, handler func(Message) error) error {
 	defer conn.Close()
 	for {
 		select {
 		case <-t.ctx.Done():
 			t.Close()
-			return
+			return nil
 		default:
 			data, err := readFramedMessage(conn)
 			if err == io.EOF {
-				return
+				return nil
 			} else if err != nil {
-				panic(err)
+				return err
+			}
+			msg, err := GetMessage(data)
+			if err != nil {
+				return err
+			}
+			if err := handler(msg); err != nil {
+				return err
 			}
-			msg := GetMessage(data)
-			handler(msg)
 		}
 	}
 }
 
-func (t *TcpServer) ReceiveMessages(handler func(Message)) {
+func (t *TcpServer) ReceiveMessages(handler func(Message) error) error {
 	listener, err := net.Listen("tcp", t.ourAddr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer listener.Close()
 
 	for {
 		// Create a channel to receive accepted connections
 		connCh := make(chan net.Conn)
+		errCh := make(chan error, 1)
 		go func() {
 			conn, err := listener.Accept()
 			if errors.Is(err, net.ErrClosed) {
 				return // listneer was closed already
 			} else if err != nil {
-				panic(err)
+				errCh <- err
+				return
 			}
 			connCh <- conn
 		}()
 
 		select {
 		case <-t.ctx.Done():
-			return
+			return nil
+		case err := <-errCh:
+			return err
 		case conn := <-connCh:
-			t.handleConnection(conn, handler)
+			if err := t.handleConnection(conn, handler); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -1,13 +1,18 @@
 package p2p
 
 import (
+	"cmp"
 	"context"
-	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/google/uuid"
@@ -19,282 +24,885 @@ const ( // message types
 	TRANSFER_INFO
 	TRANSFER_REQUEST
 	TRANSFER_RESPONSE
+	TRANSFER_RESUME
+	TRANSFER_INVALID
+	TRANSFER_PAUSE    // sent by either side, with the transfer id
+	TRANSFER_CONTINUE // undoes TRANSFER_PAUSE
+	TRANSFER_RESEND   // a chunk arrived corrupted
+	TRANSFER_RECEIVED // the recipient has all the files
 )
 
 type Transfer struct {
 	Sender     string
+	SenderName string
 	Id         string
 	Recipients []string
 	Files      map[string]*File
 
-	authorizedRecipients []string
+	deliveries *recipientTable   // only set when sending
+	byIndex    map[uint32]string // file index -> file name
+	hashed     chan struct{}     // closed once the file hashes are computed
+	hashErr    error
+	suspended  bool       // interrupted and waiting for the sender to reappear
+	pause      pauseState // only used when receiving
+	lastSaved  time.Time
+	emit       func(Event)
+	progress   *progressTracker
 }
 
 type TransferRequest struct {
 	Sender     string
 	TransferId string
 	Message    string
+	Files      []FilePreview
+	TotalSize  int64
 }
 
 type TransferResponse struct {
 	TransferId string
 	Authorized bool
+	TimedOut   bool     // declined because nobody answered the request
+	Files      []string // the files that were accepted, all of them if empty
+}
+
+// Sent by the receiver when a sender reappears, asking only for
+// the parts of each file that haven't been received yet
+type ResumeRequest struct {
+	TransferId string
+	Missing    map[string][]Range
+}
+
+// Sent by the receiver when a chunk doesn't match its hash,
+// asking for just that chunk again
+type ResendRequest struct {
+	TransferId string
+	File       string
+	Offset     int64
 }
 
 type File struct {
-	Name string
-	Size int64
+	Name        string // a relative path using forward slashes
+	Index       uint32 // identifies the file in chunk frames
+	Size        int64
+	Digest      []byte   // sha256 of the whole file
+	ChunkHashes [][]byte // sha256 of every chunk
 
-	reader     io.ReadCloser
-	amountSent int64
+	Kind       int
+	Mode       fs.FileMode // unix permission bits
+	ModTime    time.Time
+	LinkTarget string `json:",omitempty"`
+
+	reader      io.ReadCloser
+	sourcePath  string // files from a directory are opened on demand
+	spooledPath string
 
 	writer        mmap.MMap
+	received      []Range
+	corruptChunks int
 	doneReceiving bool
+	created       bool // by us, so it's ours to remove
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-type Chunk struct {
-	TransferId string
-	Filename   string
-	Offset     int64
-	Data       []byte
-}
-
-type ProgressReport struct {
-	Percentages map[string]float32
-	Done        bool
-	Started     bool
-}
-
 func NewReaderFile(name string, size int64, rc io.ReadCloser) *File {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &File{Name: name, Size: size, reader: rc, ctx: ctx, cancel: cancel}
 }
 
-func NewWriterFile(path string, size int64) *File {
-	_, err := os.Stat(path)
-	newFile := errors.Is(err, os.ErrNotExist)
-
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+// Map the file createEntry made so chunks can be written to it in any order
+func (f *File) openWriter() error {
+	file, err := os.OpenFile(f.Name, os.O_RDWR, 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 
-	if newFile {
-		err = fallocate(file, 0, size)
-		if err != nil {
-			panic(err)
-		}
+	// a resumed file keeps the chunks it already has
+	if err := file.Truncate(f.Size); err != nil {
+		return err
+	}
+	if err := fallocate(file, 0, f.Size); err != nil {
+		return err
 	}
 
-	fileData, err := mmap.Map(file, mmap.RDWR, 0)
+	f.writer, err = mmap.Map(file, mmap.RDWR, 0)
+	return err
+}
+
+// Get random access to the file's contents
+func (f *File) openReader() (io.ReaderAt, func(), error) {
+	if f.sourcePath == "" {
+		return f.reader.(io.ReaderAt), func() {}, nil
+	}
+	file, err := os.Open(f.sourcePath)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	return &File{Name: path, Size: size, writer: fileData}
+	return file, func() { file.Close() }, nil
 }
 
-func (f *File) SendChunks(sendMsg func(Message), t *Transfer) {
-	defer f.reader.Close()
+func (f *File) SendChunks(sendMsg func(Message), t *Transfer, recipient string) error {
+	return f.sendRanges(sendMsg, t, recipient, []Range{{0, f.Size}}, true)
+}
 
-	for {
-		select {
-		case <-f.ctx.Done():
-			return
-		default:
-		}
+// Resend parts of the file to a recipient
+func (f *File) SendRanges(
+	sendMsg func(Message), t *Transfer, recipient string, ranges []Range) error {
+	return f.sendRanges(sendMsg, t, recipient, ranges, false)
+}
 
-		buffer := make([]byte, 256*1024)
-		n, err := f.reader.Read(buffer)
+func (f *File) sendRanges(
+	sendMsg func(Message), t *Transfer,
+	recipient string, ranges []Range, trackProgress bool) error {
+	if f.Kind != REGULAR_FILE {
+		return nil // directories and symlinks are entirely described by the manifest
+	}
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			panic(err)
+	reader, release, err := f.openReader()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dropped := t.deliveries.context(recipient)
+	buffer := make([]byte, chunkSize) // the chunk message gets its own copy
+	for _, r := range ranges {
+		// chunks must line up with the chunk hashes
+		for offset := r.Start; offset < r.End; {
+			if !t.waitWhilePaused(f, recipient) {
+				return nil
+			}
+			select {
+			case <-f.ctx.Done():
+				return nil
+			case <-dropped.Done():
+				return nil
+			default:
+			}
+
+			n, err := reader.ReadAt(buffer[:min(chunkSize, r.End-offset)], offset)
+			if n == 0 && err != nil {
+				return fmt.Errorf("couldn't read %s: %w", f.Name, err)
+			}
+
+			chunk := Chunk{
+				TransferId: t.Id,
+				FileIndex:  f.Index,
+				Offset:     offset,
+				Data:       buffer[:n]}
+			offset += int64(n)
+
+			msg, err := NewChunkMessage(chunk)
+			if err != nil {
+				return err
+			}
+			msg.Recipients = []string{recipient}
+			sendMsg(msg)
+
+			if trackProgress {
+				t.recordSent(f, recipient, int64(n))
+			}
+			t.reportProgress(true, false)
 		}
+	}
+	return nil
+}
 
-		chunk := Chunk{
-			TransferId: t.Id,
-			Filename:   f.Name,
-			Offset:     f.amountSent,
-			Data:       buffer[:n]}
-		f.amountSent += int64(n)
-
-		msg := NewMessage(TRANSFER_CHUNK, chunk)
-		msg.Recipients = t.Recipients
-		sendMsg(msg)
+// Hold off on sending to a recipient while it's paused. Returns
+// false if the transfer was stopped while waiting.
+func (t *Transfer) waitWhilePaused(f *File, recipient string) bool {
+	for {
+		gate := t.deliveries.pauseGate(recipient)
+		if gate == nil {
+			return true
+		}
+		select {
+		case <-gate:
+		case <-f.ctx.Done():
+			return false
+		case <-t.deliveries.context(recipient).Done():
+			return false
+		}
 	}
 }
 
 func (f *File) CloseWriter() {
+	if f.writer == nil {
+		return
+	}
 	f.writer.Flush()
 	f.writer.Unmap()
+	f.writer = nil
 }
 
-func (t *Transfer) Cancel() Message {
-	for _, file := range t.Files {
-		file.cancel()
+func (f *File) closeReader() {
+	if f.reader != nil {
+		f.reader.Close()
+	}
+	if f.spooledPath != "" {
+		os.Remove(f.spooledPath)
 	}
+}
+
+func (t *Transfer) Cancel() Message {
+	t.close()
 	msg := NewMessage(TRANSFER_CANCELLED, t.Id)
 	msg.Recipients = t.Recipients
 	return msg
 }
 
+func (t *Transfer) close() {
+	for _, file := range t.Files {
+		file.cancel()
+		file.closeReader()
+	}
+	if t.deliveries != nil {
+		t.deliveries.close()
+	}
+}
+
+// Start sending to a recipient as soon as it accepts, without waiting on the others
 func (t *Transfer) handleRecipientResponse(
-	authorized bool, recipient string, sendMsg func(Message)) {
-	if !authorized {
-		sendMsg(t.Cancel())
+	response TransferResponse, recipient string, sendMsg func(Message), report func(Error)) {
+	if !response.Authorized {
+		t.deliveries.transition(recipient, RECIPIENT_REJECTED)
+		t.reportProgress(true, true)
 		return
 	}
 
-	t.authorizedRecipients = append(t.authorizedRecipients, recipient)
-	if len(t.authorizedRecipients) == len(t.Recipients) {
-		// got authorization from all the recipients, start sending files...
-		msg := NewMessage(TRANSFER_INFO, *t)
-		msg.Recipients = t.Recipients
-		sendMsg(msg)
+	if !t.deliveries.accept(recipient, response.Files) {
+		return // answered twice
+	}
+	t.reportProgress(true, true)
+	go t.sendTo(recipient, sendMsg, report)
+}
 
-		for _, file := range t.Files {
-			go file.SendChunks(sendMsg, t)
+// Send every file to a recipient, once we know what it should be checking against
+func (t *Transfer) sendTo(recipient string, sendMsg func(Message), report func(Error)) {
+	<-t.hashed
+	if t.hashErr != nil {
+		t.failRecipient(recipient, t.hashErr, sendMsg, report)
+		return
+	}
+	if !t.deliveries.transition(recipient, RECIPIENT_SENDING) {
+		return // dropped out while we were hashing
+	}
+
+	// the recipient only hears about the files it wants
+	info := *t
+	info.Files = t.filesFor(recipient)
+	msg := NewMessage(TRANSFER_INFO, info)
+	msg.Recipients = []string{recipient}
+	sendMsg(msg)
+
+	// one file at a time, since a directory could hold thousands
+	for _, file := range info.orderedFiles() {
+		if err := file.SendChunks(sendMsg, t, recipient); err != nil {
+			t.failRecipient(recipient, err, sendMsg, report)
+			return
+		}
+	}
+
+	if t.deliveries.context(recipient).Err() == nil {
+		t.deliveries.transition(recipient, RECIPIENT_DONE)
+	}
+	t.reportProgress(true, true)
+}
+
+// Give up on sending to a recipient, leaving the others alone
+func (t *Transfer) failRecipient(
+	recipient string, err error, sendMsg func(Message), report func(Error)) {
+	if !t.deliveries.transition(recipient, RECIPIENT_FAILED) {
+		return
+	}
+	report(Error{Kind: STORAGE_ERROR, PeerId: recipient, TransferId: t.Id, Message: err.Error()})
+
+	msg := NewMessage(TRANSFER_CANCELLED, t.Id)
+	msg.Recipients = []string{recipient}
+	sendMsg(msg)
+	t.reportProgress(true, true)
+}
+
+// The files a recipient accepted
+func (t *Transfer) filesFor(recipient string) map[string]*File {
+	accepted := t.deliveries.acceptedFiles(recipient)
+	if accepted == nil {
+		return t.Files
+	}
+	files := make(map[string]*File)
+	for name, f := range t.Files {
+		if accepted[name] {
+			files[name] = f
+		}
+	}
+	return files
+}
+
+// Get the name of the file a chunk belongs to
+func (t *Transfer) fileAt(index uint32) (string, bool) {
+	if t.byIndex == nil {
+		t.byIndex = make(map[uint32]string)
+		for name, file := range t.Files {
+			t.byIndex[file.Index] = name
+		}
+	}
+	name, exists := t.byIndex[index]
+	return name, exists
+}
+
+func (t *Transfer) orderedFiles() []*File {
+	files := slices.Collect(maps.Values(t.Files))
+	slices.SortFunc(files, func(a, b *File) int { return cmp.Compare(a.Index, b.Index) })
+	return files
+}
+
+func (t *Transfer) hashFiles() {
+	defer close(t.hashed)
+	for _, file := range t.Files {
+		if file.Kind != REGULAR_FILE {
+			continue
+		}
+		if err := file.computeHashes(); err != nil {
+			t.hashErr = err
+			return
 		}
 	}
 }
 
 type Sender struct {
 	transfers map[string]*Transfer
+	mutex     sync.Mutex // only guards transfers, it isn't held while sending
+	emit      func(Event)
+}
+
+func NewSender(emit func(Event)) Sender {
+	return Sender{transfers: make(map[string]*Transfer), emit: emit}
+}
+
+func (s *Sender) reportError(err Error) {
+	log.Printf("Failed: %v\n", err)
+	s.emit(err)
 }
 
-func NewSender() Sender {
-	return Sender{transfers: make(map[string]*Transfer)}
+func (s *Sender) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, t := range s.transfers {
+		t.close()
+	}
+}
+
+func (s *Sender) transfer(id string) (*Transfer, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, exists := s.transfers[id]
+	return t, exists
+}
+
+// Stop tracking a transfer, returning it unless it was already forgotten
+func (s *Sender) forget(id string) (*Transfer, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, exists := s.transfers[id]
+	delete(s.transfers, id)
+	return t, exists
 }
 
 func (s *Sender) StartTransfer(
-	recipients []string, files map[string]*File, sendMsg func(Message)) string {
+	recipients []string, files map[string]*File,
+	senderName string, sendMsg func(Message)) string {
+	names := slices.Sorted(maps.Keys(files))
+	for i, name := range names {
+		files[name].Index = uint32(i)
+	}
+
 	id := uuid.NewString()
-	s.transfers[id] = &Transfer{
-		Sender:     deviceName(),
+	t := &Transfer{
+		Sender:     deviceId(),
+		SenderName: senderName,
 		Id:         id,
 		Recipients: recipients,
 		Files:      files,
+		deliveries: newRecipientTable(recipients),
+		hashed:     make(chan struct{}),
+		emit:       s.emit,
+		progress:   &progressTracker{},
 	}
+	// before hashing, which might spool the files somewhere else
+	previews, totalSize := previewFiles(files)
+	s.mutex.Lock()
+	s.transfers[id] = t
+	s.mutex.Unlock()
+	go t.hashFiles()
 	request := TransferRequest{
-		Sender:     deviceName(),
+		Sender:     deviceId(),
 		TransferId: id,
-		Message:    fmt.Sprintf("Accept files from %s?", deviceName())}
+		Message:    fmt.Sprintf("Accept files from %s?", senderName),
+		Files:      previews,
+		TotalSize:  totalSize,
+	}
 	msg := NewMessage(TRANSFER_REQUEST, request)
 	msg.Recipients = recipients
 	sendMsg(msg)
 	return id
 }
 
+func (s *Sender) HasTransfer(id string) bool {
+	_, exists := s.transfer(id)
+	return exists
+}
+
+// Pause or unpause sending to every recipient, letting them know
+func (s *Sender) SetPaused(id string, paused bool, sendMsg func(Message)) {
+	t, exists := s.transfer(id)
+	if !exists || !t.deliveries.pauseAll(paused) {
+		return
+	}
+
+	msgType := TRANSFER_CONTINUE
+	if paused {
+		msgType = TRANSFER_PAUSE
+	}
+	msg := NewMessage(msgType, id)
+	msg.Recipients = t.Recipients
+	sendMsg(msg)
+	t.reportProgress(true, true)
+}
+
+// A recipient paused or unpaused the transfer, which only affects what we send it
+func (s *Sender) HandlePause(recipient string, id string, paused bool) {
+	t, exists := s.transfer(id)
+	if exists && t.deliveries.setPaused(recipient, true, paused) {
+		t.reportProgress(true, true)
+	}
+}
+
+// A recipient doesn't want the rest of the files
+func (s *Sender) HandleCancel(recipient string, id string) {
+	t, exists := s.transfer(id)
+	if !exists || !t.deliveries.transition(recipient, RECIPIENT_CANCELLED) {
+		return
+	}
+	s.emit(TransferFailed{TransferId: id, PeerId: recipient, Cancelled: true})
+	t.reportProgress(true, true)
+	s.forgetIfFinished(t)
+}
+
 func (s *Sender) CancelTransfer(id string, sendMsg func(Message)) {
-	_, exists := s.transfers[id]
+	t, exists := s.forget(id)
 	if !exists {
 		return
 	}
-	sendMsg(s.transfers[id].Cancel())
-	delete(s.transfers, id)
+	sendMsg(t.Cancel())
 }
 
 func (s *Sender) HandleTransferResponse(
 	recipient string, response TransferResponse, sendMsg func(Message)) {
-	_, exists := s.transfers[response.TransferId]
+	t, exists := s.transfer(response.TransferId)
 	if !exists {
 		return
 	}
+	t.handleRecipientResponse(response, recipient, sendMsg, s.reportError)
+	s.forgetIfFinished(t)
+}
 
-	t := s.transfers[response.TransferId]
-	t.handleRecipientResponse(response.Authorized, recipient, sendMsg)
+// A recipient refused to write the files we described, or couldn't
+func (s *Sender) HandleRejection(recipient string, rejection ManifestRejection) {
+	t, exists := s.transfer(rejection.TransferId)
+	if !exists {
+		return
+	}
+	t.deliveries.transition(recipient, RECIPIENT_FAILED)
+	t.reportProgress(true, true)
+	s.forgetIfFinished(t)
 }
 
-func (s *Sender) GetProgressReport(transferId string) ProgressReport {
-	report := ProgressReport{Percentages: make(map[string]float32)}
+// Stop holding on to the files once nobody needs them anymore
+func (s *Sender) forgetIfFinished(t *Transfer) {
+	if !t.deliveries.allFinished() {
+		return
+	}
+	if _, exists := s.forget(t.Id); exists {
+		t.close()
+	}
+}
 
-	_, exists := s.transfers[transferId]
-	if !exists {
-		return report
+// Send the missing parts of a transfer to a recipient that reconnected
+func (s *Sender) HandleResume(
+	recipient string, request ResumeRequest, sendMsg func(Message)) {
+	t, exists := s.transfer(request.TransferId)
+	if exists && !validResume(t.filesFor(recipient), request) {
+		s.reportError(Error{
+			Kind: PROTOCOL_ERROR, PeerId: recipient, TransferId: request.TransferId,
+			Message: "asked to resume parts of files it can't have"})
+		exists = false
+	}
+	if !exists || !t.deliveries.transition(recipient, RECIPIENT_SENDING) {
+		// we don't know about the transfer anymore, or the recipient
+		// dropped out of it, so give up on it
+		msg := NewMessage(TRANSFER_CANCELLED, request.TransferId)
+		msg.Recipients = []string{recipient}
+		sendMsg(msg)
+		return
 	}
 
-	report.Done = true
-	report.Started = true
-	for _, f := range s.transfers[transferId].Files {
-		p := float32(float64(f.amountSent) / float64(f.Size))
-		report.Percentages[f.Name] = p
+	go func() {
+		for name, ranges := range request.Missing {
+			file := t.Files[name]
+			if err := file.SendRanges(sendMsg, t, recipient, ranges); err != nil {
+				t.failRecipient(recipient, err, sendMsg, s.reportError)
+				return
+			}
+		}
+		if t.deliveries.context(recipient).Err() == nil {
+			t.deliveries.transition(recipient, RECIPIENT_DONE)
+		}
+		t.reportProgress(true, true)
+	}()
+}
 
-		if p < 0.0001 {
-			report.Started = false
+// Whether a recipient only asked for whole chunks of files it accepted
+func validResume(files map[string]*File, request ResumeRequest) bool {
+	for name, ranges := range request.Missing {
+		file, accepted := files[name]
+		if !accepted {
+			return false
 		}
-		if p < 1.0 {
-			report.Done = false
+		for _, r := range ranges {
+			if r.Start < 0 || r.Start >= r.End || r.End > file.Size ||
+				r.Start%chunkSize != 0 || (r.End%chunkSize != 0 && r.End != file.Size) {
+				return false
+			}
 		}
 	}
-	return report
+	return true
+}
+
+// A recipient has everything we sent it
+func (s *Sender) HandleReceived(recipient string, id string) {
+	t, exists := s.transfer(id)
+	if !exists {
+		return
+	}
+	// it can answer before we've noticed we're done sending
+	if !t.deliveries.transition(recipient, RECIPIENT_DELIVERED) {
+		return
+	}
+	s.emit(TransferDelivered{TransferId: id, PeerId: recipient})
+	t.reportProgress(true, true)
+	s.forgetIfFinished(t)
+}
+
+// Send a chunk that arrived corrupted again. Unlike resuming, this
+// leaves the rest of the transfer alone, since it's still being sent.
+func (s *Sender) HandleResend(
+	recipient string, request ResendRequest, sendMsg func(Message)) {
+	t, exists := s.transfer(request.TransferId)
+	if !exists {
+		return
+	}
+	file, accepted := t.filesFor(recipient)[request.File]
+	if !accepted || request.Offset < 0 ||
+		request.Offset >= file.Size || request.Offset%chunkSize != 0 {
+		return
+	}
+	state := t.deliveries.snapshot()[recipient]
+	if state != RECIPIENT_SENDING && state != RECIPIENT_DONE {
+		return
+	}
+
+	end := min(request.Offset+chunkSize, file.Size)
+	go func() {
+		err := file.SendRanges(sendMsg, t, recipient, []Range{{request.Offset, end}})
+		if err != nil {
+			t.failRecipient(recipient, err, sendMsg, s.reportError)
+		}
+	}()
+}
+
+// A transfer we said yes to, whose files haven't been described yet
+type acceptedTransfer struct {
+	sender string
+	files  map[string]bool // nil if we wanted all of them
 }
 
 type Receiver struct {
-	transfers      map[string]Transfer
+	transfers      map[string]*Transfer
+	accepted       map[string]acceptedTransfer // transfer id -> what we agreed to receive
 	mutex          sync.Mutex
 	downloadFolder *string
-	appEvents      chan Message
+	emit           func(Event)
 }
 
-func NewReceiver(downloadFolder *string, appEvents chan Message) Receiver {
+func NewReceiver(downloadFolder *string, emit func(Event)) Receiver {
+	transfers := make(map[string]*Transfer)
+
+	// pick up the transfers that were interrupted last time
+	interrupted, err := loadJournals(*downloadFolder)
+	if err != nil {
+		log.Printf("Failed to load transfer journals: %v\n", err)
+	}
+	for _, t := range interrupted {
+		t.emit = emit
+		t.progress = &progressTracker{}
+		transfers[t.Id] = t
+	}
+
 	return Receiver{
-		transfers:      make(map[string]Transfer),
+		transfers:      transfers,
+		accepted:       make(map[string]acceptedTransfer),
 		downloadFolder: downloadFolder,
-		appEvents:      appEvents,
+		emit:           emit,
 	}
 }
 
 func (r *Receiver) Close() {
-	for _, transfer := range r.transfers {
-		for _, file := range transfer.Files {
-			file.CloseWriter()
-		}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, t := range r.transfers {
+		r.suspendTransfer(t)
+	}
+}
+
+// Keep what we've received so far so the transfer can be resumed later
+func (r *Receiver) suspendTransfer(t *Transfer) {
+	if t.suspended {
+		return
+	}
+	for _, file := range t.Files {
+		file.CloseWriter()
+	}
+	if err := saveJournal(*r.downloadFolder, t); err != nil {
+		log.Printf("Failed to save the journal for %s: %v\n", t.Id, err)
 	}
+	t.suspended = true
 }
 
-func (r *Receiver) Cancel(disconnectedPeer string) {
+// Pause all the transfers from a peer that disconnected
+func (r *Receiver) Suspend(disconnectedPeer string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	for _, t := range r.transfers {
 		if t.Sender == disconnectedPeer {
-			r.HandleCancel(t.Id)
+			r.suspendTransfer(t)
+		}
+	}
+}
+
+// Ask a peer that reconnected for the rest of its interrupted transfers
+func (r *Receiver) Resume(peer string, sendMsg func(Message)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, t := range r.transfers {
+		if t.Sender != peer || !t.suspended {
+			continue
+		}
+
+		request := ResumeRequest{
+			TransferId: t.Id,
+			Missing:    make(map[string][]Range),
 		}
+		for name, file := range t.Files {
+			if file.doneReceiving {
+				continue
+			}
+			if _, err := os.Stat(file.Name); err != nil {
+				file.received = nil // the partial file is gone, start over
+				if err := createEntry(file, *r.downloadFolder); err != nil {
+					log.Printf("Failed to recreate %s: %v\n", file.Name, err)
+				}
+			}
+			request.Missing[name] = missingRanges(file.received, file.Size)
+		}
+		t.suspended = false
+
+		msg := NewMessage(TRANSFER_RESUME, request)
+		msg.Recipients = []string{peer}
+		sendMsg(msg)
+	}
+}
+
+// The sender stopped the transfer
+func (r *Receiver) HandleCancel(sender string, transferId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if accepted, exists := r.accepted[transferId]; exists && accepted.sender == sender {
+		delete(r.accepted, transferId) // it stopped before it got going
 	}
+	t, exists := r.transfers[transferId]
+	if !exists || t.Sender != sender {
+		return
+	}
+	r.discardTransfer(t)
+	r.emit(TransferFailed{TransferId: transferId, PeerId: sender, Cancelled: true})
 }
 
-func (r *Receiver) HandleCancel(transferId string) {
-	_, exists := r.transfers[transferId]
+// Stop receiving a transfer, and tell the sender to stop sending it
+func (r *Receiver) Cancel(transferId string, sendMsg func(Message)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.transfers[transferId]
 	if !exists {
 		return
 	}
+	r.discardTransfer(t)
 
+	msg := NewMessage(TRANSFER_CANCELLED, transferId)
+	msg.Recipients = []string{t.Sender}
+	sendMsg(msg)
+}
+
+func (r *Receiver) discardTransfer(t *Transfer) {
+	removeEntries(t)
+	if err := removeJournal(*r.downloadFolder, t.Id); err != nil {
+		log.Printf("Failed to remove the journal for %s: %v\n", t.Id, err)
+	}
+	delete(r.transfers, t.Id)
+}
+
+func (r *Receiver) HasTransfer(id string) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	_, exists := r.transfers[id]
+	return exists
+}
 
-	for _, file := range r.transfers[transferId].Files {
-		file.CloseWriter()
-		if err := os.Remove(file.Name); err != nil {
-			panic(err)
+// Ask the sender to hold off, or to carry on. What's
+// been received so far stays mapped in the meantime.
+func (r *Receiver) SetPaused(transferId string, paused bool, sendMsg func(Message)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.transfers[transferId]
+	if !exists || t.pause.here == paused {
+		return
+	}
+	t.pause.here = paused
+
+	msgType := TRANSFER_CONTINUE
+	if paused {
+		msgType = TRANSFER_PAUSE
+	}
+	msg := NewMessage(msgType, transferId)
+	msg.Recipients = []string{t.Sender}
+	sendMsg(msg)
+	t.reportProgress(false, true)
+}
+
+// The sender paused or unpaused the transfer
+func (r *Receiver) HandlePause(sender string, transferId string, paused bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.transfers[transferId]
+	if !exists || t.Sender != sender || t.pause.there == paused {
+		return
+	}
+	t.pause.there = paused
+	t.reportProgress(false, true)
+}
+
+// Remember a transfer we accepted, so that only the files we agreed to get written
+func (r *Receiver) Expect(sender string, response TransferResponse) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	accepted := acceptedTransfer{sender: sender}
+	if len(response.Files) > 0 {
+		accepted.files = make(map[string]bool)
+		for _, name := range response.Files {
+			accepted.files[name] = true
 		}
 	}
-	delete(r.transfers, transferId)
+	r.accepted[response.TransferId] = accepted
 }
 
-func (r *Receiver) HandleInfo(transfer Transfer) {
+func (r *Receiver) HandleInfo(transfer Transfer, sendMsg func(Message)) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	r.transfers[transfer.Id] = transfer
+	accepted, exists := r.accepted[transfer.Id]
+	if !exists || accepted.sender != transfer.Sender {
+		log.Printf("Ignoring files from %s that we never accepted\n", transfer.Sender)
+		return
+	}
+	delete(r.accepted, transfer.Id)
+	if _, exists := r.transfers[transfer.Id]; exists {
+		return
+	}
+
+	err := validateManifest(&transfer)
+	for name := range transfer.Files {
+		if err == nil && accepted.files != nil && !accepted.files[name] {
+			err = fmt.Errorf("%q wasn't accepted", name)
+		}
+	}
+	if err != nil {
+		rejection := ManifestRejection{TransferId: transfer.Id, Reason: err.Error()}
+		msg := NewMessage(TRANSFER_INVALID, rejection)
+		msg.Recipients = []string{transfer.Sender}
+		sendMsg(msg)
+
+		r.emit(TransferFailed{
+			TransferId: transfer.Id, PeerId: transfer.Sender,
+			Reason: fmt.Sprintf("refused unsafe files: %s", err)})
+		return
+	}
+
+	transfer.emit = r.emit
+	transfer.progress = &progressTracker{}
+	r.transfers[transfer.Id] = &transfer
 	for _, f := range transfer.Files {
-		path := path.Join(*r.downloadFolder, f.Name)
-		r.transfers[transfer.Id].Files[f.Name] = NewWriterFile(path, f.Size)
+		f.Name = path.Join(*r.downloadFolder, f.Name)
+		if err := createEntry(f, *r.downloadFolder); err != nil {
+			r.abortTransfer(&transfer, err, sendMsg)
+			return
+		}
+	}
+	r.handleTransferCompletion(transfer.Id, sendMsg) // in case all the files are empty
+}
+
+// Throw away a transfer whose files can't be trusted, and tell the sender
+func (r *Receiver) failTransfer(t *Transfer, reason string, sendMsg func(Message)) {
+	rejection := ManifestRejection{
+		TransferId: t.Id, Corrupted: true,
+		Reason: fmt.Sprintf("the files were corrupted: %s", reason)}
+	r.dropTransfer(t, rejection, sendMsg)
+	r.emit(TransferFailed{
+		TransferId: t.Id, PeerId: t.Sender, Corrupted: true, Reason: rejection.Reason})
+}
+
+// Give up on a transfer we can't write to disk, and tell the sender to stop
+func (r *Receiver) abortTransfer(t *Transfer, err error, sendMsg func(Message)) {
+	rejection := ManifestRejection{TransferId: t.Id, Reason: "the recipient couldn't save the files"}
+	r.dropTransfer(t, rejection, sendMsg)
+	log.Printf("Failed to save the files of %s: %v\n", t.Id, err)
+	r.emit(Error{
+		Kind: STORAGE_ERROR, PeerId: t.Sender, TransferId: t.Id, Message: err.Error()})
+}
+
+// Remove everything we have of a transfer so the sender stops waiting on us
+func (r *Receiver) dropTransfer(
+	t *Transfer, rejection ManifestRejection, sendMsg func(Message)) {
+	removeEntries(t)
+	if err := removeJournal(*r.downloadFolder, t.Id); err != nil {
+		log.Printf("Failed to remove the journal for %s: %v\n", t.Id, err)
 	}
+	delete(r.transfers, t.Id)
+
+	msg := NewMessage(TRANSFER_INVALID, rejection)
+	msg.Recipients = []string{t.Sender}
+	sendMsg(msg)
 }
 
-func (r *Receiver) handleTransferCompletion(id string) {
+func (r *Receiver) handleTransferCompletion(id string, sendMsg func(Message)) {
 	allDone := true
 	t := r.transfers[id]
 	for _, file := range t.Files {
@@ -305,39 +913,95 @@ func (r *Receiver) handleTransferCompletion(id string) {
 	}
 
 	if allDone {
+		t.reportProgress(false, true)
+		applyMetadata(t, *r.downloadFolder)
 		delete(r.transfers, id)
-		str := fmt.Sprintf("Received %d from %s", len(t.Files), t.Sender)
-		r.appEvents <- NewMessage(NOTIFY_COMPLETION, str)
+		if err := removeJournal(*r.downloadFolder, id); err != nil {
+			log.Printf("Failed to remove the journal for %s: %v\n", id, err)
+		}
+		r.emit(TransferCompleted{
+			TransferId: id, PeerId: t.Sender,
+			SenderName: t.SenderName, Files: len(t.Files)})
+
+		// so the sender knows it can stop
+		msg := NewMessage(TRANSFER_RECEIVED, id)
+		msg.Recipients = []string{t.Sender}
+		sendMsg(msg)
+	} else if time.Since(t.lastSaved) >= journalInterval {
+		// the data must hit the disk before the journal says it did
+		for _, file := range t.Files {
+			if file.writer != nil {
+				file.writer.Flush()
+			}
+		}
+		if err := saveJournal(*r.downloadFolder, t); err != nil {
+			log.Printf("Failed to save the journal for %s: %v\n", id, err)
+		}
+		t.lastSaved = time.Now()
 	}
+	t.reportProgress(false, false)
 }
 
-func (r *Receiver) HandleChunk(chunk Chunk) {
-	_, exists := r.transfers[chunk.TransferId]
+func (r *Receiver) HandleChunk(chunk Chunk, sendMsg func(Message)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.transfers[chunk.TransferId]
+	if !exists || t.suspended {
+		return
+	}
+
+	name, exists := t.fileAt(chunk.FileIndex)
 	if !exists {
 		return
 	}
+	file := t.Files[name]
+	if file.doneReceiving {
+		return
+	}
+	length := int64(len(chunk.Data))
 
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	if file.writer == nil {
+		if err := file.openWriter(); err != nil {
+			r.abortTransfer(t, err, sendMsg)
+			return
+		}
+	}
 
-	file, exists := r.transfers[chunk.TransferId].Files[chunk.Filename]
-	if !exists {
+	if !file.verifyChunk(chunk) {
+		file.corruptChunks++
+		if file.corruptChunks > maxCorruptChunks {
+			r.failTransfer(t, "too many corrupted chunks", sendMsg)
+			return
+		}
+
+		// ask for the chunk again
+		request := ResendRequest{TransferId: t.Id, File: name, Offset: chunk.Offset}
+		msg := NewMessage(TRANSFER_RESEND, request)
+		msg.Recipients = []string{t.Sender}
+		sendMsg(msg)
 		return
 	}
-	chunkSize := int64(len(chunk.Data))
 
 	if err := file.writer.Lock(); err != nil {
-		panic(err)
+		r.abortTransfer(t, err, sendMsg)
+		return
 	}
 	copy(file.writer[chunk.Offset:], chunk.Data)
 	if err := file.writer.Unlock(); err != nil {
-		panic(err)
+		r.abortTransfer(t, err, sendMsg)
+		return
 	}
 
-	doneWriting := chunk.Offset+chunkSize >= file.Size
-	if doneWriting {
+	file.received = addRange(file.received,
+		Range{chunk.Offset, chunk.Offset + length})
+	if len(missingRanges(file.received, file.Size)) == 0 {
+		if !file.verifyDigest() {
+			r.failTransfer(t, "checksum mismatch", sendMsg)
+			return
+		}
 		file.doneReceiving = true
 		file.CloseWriter()
-		r.handleTransferCompletion(chunk.TransferId)
 	}
+	r.handleTransferCompletion(chunk.TransferId, sendMsg)
 }
@@ -0,0 +1,250 @@
+package p2p
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A sender with a transfer of one file that's already been sent to a recipient
+func sentTransfer(t *testing.T, contents []byte) (*Sender, *Transfer) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	transfer := &Transfer{
+		Id:         uuid.NewString(),
+		Recipients: []string{"recipient"},
+		Files:      map[string]*File{"a": NewReaderFile("a", int64(len(contents)), file)},
+		deliveries: newRecipientTable([]string{"recipient"}),
+		progress:   &progressTracker{},
+	}
+	transfer.deliveries.accept("recipient", nil)
+	transfer.deliveries.transition("recipient", RECIPIENT_SENDING)
+	transfer.deliveries.transition("recipient", RECIPIENT_DONE)
+
+	sender := NewSender(func(Event) {})
+	sender.transfers[transfer.Id] = transfer
+	return &sender, transfer
+}
+
+func TestResendOnlySendsTheNamedChunk(t *testing.T) {
+	contents := bytes.Repeat([]byte("drip"), chunkSize) // 4 chunks
+	sender, transfer := sentTransfer(t, contents)
+
+	sent := make(chan Message, 16)
+	request := ResendRequest{TransferId: transfer.Id, File: "a", Offset: 2 * chunkSize}
+	sender.HandleResend("recipient", request, func(msg Message) { sent <- msg })
+
+	select {
+	case msg := <-sent:
+		chunk, err := GetChunk(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Offset != request.Offset || !bytes.Equal(chunk.Data, contents[2*chunkSize:3*chunkSize]) {
+			t.Fatalf("resent the chunk at %d instead of %d", chunk.Offset, request.Offset)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the chunk wasn't resent")
+	}
+	select {
+	case msg := <-sent:
+		t.Fatalf("sent more than the chunk that was asked for: %v", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if state := transfer.deliveries.snapshot()["recipient"]; state != RECIPIENT_DONE {
+		t.Fatalf("resending moved the recipient to state %d", state)
+	}
+}
+
+func TestResendIgnoresBadRequests(t *testing.T) {
+	sender, transfer := sentTransfer(t, bytes.Repeat([]byte("drip"), chunkSize))
+	requests := map[string]ResendRequest{
+		"unknown transfer": {TransferId: "other", File: "a"},
+		"unknown file":     {TransferId: transfer.Id, File: "b"},
+		"misaligned":       {TransferId: transfer.Id, File: "a", Offset: 10},
+		"past the end":     {TransferId: transfer.Id, File: "a", Offset: 4 * chunkSize},
+	}
+	for name, request := range requests {
+		sent := false
+		sender.HandleResend("recipient", request, func(Message) { sent = true })
+		time.Sleep(50 * time.Millisecond)
+		if sent {
+			t.Errorf("%s: resent a chunk", name)
+		}
+	}
+
+	sent := false
+	request := ResendRequest{TransferId: transfer.Id, File: "a"}
+	sender.HandleResend("stranger", request, func(Message) { sent = true })
+	time.Sleep(50 * time.Millisecond)
+	if sent {
+		t.Error("resent a chunk to someone who isn't a recipient")
+	}
+}
+
+func TestResumeRefusesBadRequests(t *testing.T) {
+	sender, transfer := sentTransfer(t, bytes.Repeat([]byte("drip"), chunkSize))
+	requests := map[string]map[string][]Range{
+		"unknown file": {"b": {{0, chunkSize}}},
+		"misaligned":   {"a": {{10, chunkSize}}},
+		"past the end": {"a": {{3 * chunkSize, 5 * chunkSize}}},
+		"backwards":    {"a": {{chunkSize, 0}}},
+	}
+	for name, missing := range requests {
+		var sent []Message
+		request := ResumeRequest{TransferId: transfer.Id, Missing: missing}
+		sender.HandleResume("recipient", request, func(msg Message) { sent = append(sent, msg) })
+		time.Sleep(50 * time.Millisecond)
+		if len(sent) != 1 || sent[0].Type != TRANSFER_CANCELLED {
+			t.Errorf("%s: the request wasn't refused", name)
+		}
+	}
+}
+
+func TestDeliveredTransfersAreForgotten(t *testing.T) {
+	sender, transfer := sentTransfer(t, []byte("drip"))
+	sender.HandleReceived("stranger", transfer.Id)
+	if !sender.HasTransfer(transfer.Id) {
+		t.Fatal("forgot a transfer someone else said they had")
+	}
+
+	sender.HandleReceived("recipient", transfer.Id)
+	if sender.HasTransfer(transfer.Id) {
+		t.Fatal("held on to a transfer that was delivered")
+	}
+	if transfer.deliveries.context("recipient").Err() == nil {
+		t.Error("the transfer was never closed")
+	}
+}
+
+// The messages a receiver sent, and the events it emitted
+type receiverLog struct {
+	sent   []Message
+	events []Event
+}
+
+func newTestReceiver(t *testing.T) (*Receiver, *receiverLog) {
+	folder := t.TempDir()
+	seen := &receiverLog{}
+	r := NewReceiver(&folder, func(e Event) { seen.events = append(seen.events, e) })
+	return &r, seen
+}
+
+// A manifest of empty files, which are done as soon as they're created
+func emptyFiles(sender string, names ...string) Transfer {
+	files := make(map[string]*File)
+	for i, name := range names {
+		files[name] = &File{Name: name, Index: uint32(i), Kind: REGULAR_FILE}
+	}
+	return Transfer{Id: uuid.NewString(), Sender: sender, Files: files}
+}
+
+func TestReceiverOnlyTakesAcceptedTransfers(t *testing.T) {
+	r, seen := newTestReceiver(t)
+	info := emptyFiles("sender", "a")
+	r.HandleInfo(info, func(msg Message) { seen.sent = append(seen.sent, msg) })
+
+	if entries, _ := os.ReadDir(*r.downloadFolder); len(entries) != 0 {
+		t.Fatal("wrote files nobody accepted")
+	}
+
+	// accepted, but from someone else
+	r.Expect("other", TransferResponse{TransferId: info.Id, Authorized: true})
+	r.HandleInfo(info, func(msg Message) { seen.sent = append(seen.sent, msg) })
+	if entries, _ := os.ReadDir(*r.downloadFolder); len(entries) != 0 {
+		t.Fatal("wrote files accepted from another peer")
+	}
+
+	r.Expect("sender", TransferResponse{TransferId: info.Id, Authorized: true})
+	r.HandleInfo(info, func(msg Message) { seen.sent = append(seen.sent, msg) })
+	if _, err := os.Stat(filepath.Join(*r.downloadFolder, "a")); err != nil {
+		t.Fatal("the accepted files weren't written")
+	}
+}
+
+func TestReceiverOnlyTakesAcceptedFiles(t *testing.T) {
+	r, seen := newTestReceiver(t)
+	info := emptyFiles("sender", "a", "b")
+	r.Expect("sender", TransferResponse{TransferId: info.Id, Authorized: true, Files: []string{"a"}})
+	r.HandleInfo(info, func(msg Message) { seen.sent = append(seen.sent, msg) })
+
+	if entries, _ := os.ReadDir(*r.downloadFolder); len(entries) != 0 {
+		t.Fatal("wrote files from a manifest with files that weren't accepted")
+	}
+	if len(seen.sent) != 1 || seen.sent[0].Type != TRANSFER_INVALID {
+		t.Fatal("the sender wasn't told the manifest was refused")
+	}
+}
+
+// Run with -race, the node calls into the sender from many goroutines
+func TestSenderIsSafeToShare(t *testing.T) {
+	sender := NewSender(func(Event) {})
+	defer sender.Close()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				files := map[string]*File{"a": NewReaderFile("a", 0, nopReaderAt{})}
+				id := sender.StartTransfer([]string{"recipient"}, files, "test", func(Message) {})
+				sender.HasTransfer(id)
+				sender.SetPaused(id, true, func(Message) {})
+				sender.HandleTransferResponse("recipient",
+					TransferResponse{TransferId: id, Authorized: false}, func(Message) {})
+				sender.CancelTransfer(id, func(Message) {})
+			}
+		}()
+	}
+	wg.Wait()
+	if len(sender.transfers) != 0 {
+		t.Fatalf("%d transfers were never forgotten", len(sender.transfers))
+	}
+}
+
+func TestReceiverReportsCorruptedFiles(t *testing.T) {
+	r, seen := newTestReceiver(t)
+	send := func(msg Message) { seen.sent = append(seen.sent, msg) }
+	data := []byte("a")
+	info := Transfer{Id: uuid.NewString(), Sender: "sender", Files: map[string]*File{
+		"a": {Name: "a", Kind: REGULAR_FILE, Size: int64(len(data)),
+			ChunkHashes: [][]byte{hashChunk(data)}, Digest: make([]byte, 32)},
+	}}
+	r.Expect("sender", TransferResponse{TransferId: info.Id, Authorized: true})
+	r.HandleInfo(info, send)
+	r.HandleChunk(Chunk{TransferId: info.Id, Offset: 0, Data: data}, send)
+
+	if _, err := os.Stat(filepath.Join(*r.downloadFolder, "a")); err == nil {
+		t.Error("kept a corrupted file")
+	}
+	if len(seen.sent) != 1 || seen.sent[0].Type != TRANSFER_INVALID {
+		t.Fatal("the sender wasn't told the files were corrupted")
+	}
+	rejection, err := Deserialize[ManifestRejection](seen.sent[0])
+	if err != nil || !rejection.Corrupted {
+		t.Error("the sender wasn't told the files were corrupted")
+	}
+	corrupted := false
+	for _, event := range seen.events {
+		if failed, ok := event.(TransferFailed); ok {
+			corrupted = failed.Corrupted
+		}
+	}
+	if !corrupted {
+		t.Error("the corrupted transfer wasn't reported as corrupted")
+	}
+}
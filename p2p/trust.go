@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A device we've paired with
+type TrustedPeer struct {
+	Id        string
+	Name      string // what it was called when we paired
+	PublicKey ed25519.PublicKey
+	PairedAt  time.Time
+}
+
+// Remembers the devices we've paired with across sessions
+type TrustStore struct {
+	peers map[string]TrustedPeer
+	path  string
+	mu    sync.Mutex
+}
+
+func LoadTrustStore(dataFolder string) (*TrustStore, error) {
+	s := &TrustStore{
+		peers: make(map[string]TrustedPeer),
+		path:  filepath.Join(dataFolder, "trusted_peers.json"),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.peers); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TrustStore) save() error {
+	data, err := json.Marshal(s.peers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+func (s *TrustStore) Add(id string, name string, key ed25519.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[id] = TrustedPeer{Id: id, Name: name, PublicKey: key, PairedAt: time.Now()}
+	return s.save()
+}
+
+func (s *TrustStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, id)
+	return s.save()
+}
+
+// Check a key against the one we paired with. Returns whether
+// we've paired with the device and whether the keys matched.
+func (s *TrustStore) Check(id string, key ed25519.PublicKey) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, exists := s.peers[id]
+	if !exists {
+		return false, false
+	}
+	return true, bytes.Equal(peer.PublicKey, key)
+}
+
+// Find a device we've paired with by name, ignoring case
+func (s *TrustStore) Named(name string) (TrustedPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, peer := range s.peers {
+		if peer.Name != "" && strings.EqualFold(peer.Name, name) {
+			return peer, true
+		}
+	}
+	return TrustedPeer{}, false
+}
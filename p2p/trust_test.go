@@ -0,0 +1,38 @@
+package p2p
+
+import "testing"
+
+func TestTrustStoreLastsAcrossLaunches(t *testing.T) {
+	folder := t.TempDir()
+	laptop, phone, stranger := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	store, err := LoadTrustStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(laptop.DeviceId(), "laptop", laptop.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(phone.DeviceId(), "phone", phone.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove(phone.DeviceId()); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = LoadTrustStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paired, matches := store.Check(laptop.DeviceId(), laptop.PublicKey); !paired || !matches {
+		t.Fatal("forgot the laptop")
+	}
+	if paired, matches := store.Check(laptop.DeviceId(), stranger.PublicKey); !paired || matches {
+		t.Fatal("accepted someone else's key for the laptop")
+	}
+	if paired, _ := store.Check(phone.DeviceId(), phone.PublicKey); paired {
+		t.Fatal("still trusts the phone after it was removed")
+	}
+	if peer, exists := store.Named("Laptop"); !exists || peer.Id != laptop.DeviceId() {
+		t.Fatal("the laptop's name was lost")
+	}
+}
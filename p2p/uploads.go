@@ -0,0 +1,361 @@
+package p2p
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how long an accepted upload can go without any data before it's thrown away
+const uploadIdleTimeout = time.Minute
+
+// Files uploaded to us over http, by LocalSend devices or from a browser.
+// They're written straight to the download folder instead of arriving in
+// chunks, but are asked about and reported on like any other transfer.
+
+var (
+	errUnsafeFiles    = errors.New("refused unsafe files")
+	errDeclined       = errors.New("declined")
+	errWithdrawn      = errors.New("the sender stopped waiting")
+	errUnknownSession = errors.New("unknown session")
+	errInvalidToken   = errors.New("invalid token")
+)
+
+// A file someone wants to upload
+type offeredFile struct {
+	Id       string // what the sender calls it when uploading it
+	Name     string
+	Size     int64
+	MimeType string
+}
+
+type uploadSession struct {
+	transfer *Transfer
+	files    map[string]string // file id -> name in transfer.Files
+	tokens   map[string]string // file id -> the token its upload has to include
+	uploaded map[string]bool   // file ids, empty files are created early but still uploaded
+	mu       sync.Mutex        // guards the transfer's files and uploaded
+
+	ctx    context.Context // cancelled when either side gives up
+	cancel context.CancelFunc
+	idle   *time.Timer // discards the session when the sender goes quiet
+}
+
+type uploadReceiver struct {
+	node        *Node
+	sessions    map[string]*uploadSession // transfer id -> session
+	idleTimeout time.Duration             // swapped out in tests
+	mu          sync.Mutex
+}
+
+func newUploadReceiver(n *Node) *uploadReceiver {
+	return &uploadReceiver{
+		node: n, sessions: make(map[string]*uploadSession), idleTimeout: uploadIdleTimeout}
+}
+
+// Ask the user about files someone wants to upload, waiting until they answer
+// or ctx is cancelled. Returns the session and a token for each accepted file.
+func (u *uploadReceiver) request(
+	ctx context.Context, peerId string, senderName string,
+	files []offeredFile) (string, map[string]string, error) {
+	session, previews, err := u.newSession(peerId, senderName, files)
+	if err != nil {
+		session.cancel()
+		u.node.emit(TransferFailed{
+			TransferId: session.transfer.Id, PeerId: peerId,
+			Reason: fmt.Sprintf("refused unsafe files: %s", err)})
+		return "", nil, fmt.Errorf("%w: %v", errUnsafeFiles, err)
+	}
+	t := session.transfer
+
+	answers := make(chan TransferResponse, 1)
+	u.node.addRequest(t.Id, peerId, func(response TransferResponse) { answers <- response })
+	totalSize := int64(0)
+	for _, p := range previews {
+		totalSize += p.Size
+	}
+	u.node.emit(TransferRequested{
+		TransferId: t.Id,
+		PeerId:     peerId,
+		Message:    fmt.Sprintf("Accept files from %s?", senderName),
+		Files:      previews,
+		TotalSize:  totalSize,
+	})
+
+	var response TransferResponse
+	select {
+	case response = <-answers:
+	case <-ctx.Done():
+		// take the request back, there's nobody to answer anymore
+		session.cancel()
+		if request, exists := u.node.takeRequest(t.Id); exists {
+			request.timer.Stop()
+			u.node.emit(RequestExpired{TransferId: t.Id, PeerId: peerId})
+		}
+		return "", nil, errWithdrawn
+	}
+	if !response.Authorized {
+		session.cancel()
+		return "", nil, errDeclined
+	}
+
+	if err := u.open(session, response.Files); err != nil {
+		session.cancel()
+		log.Printf("Failed to save the files of %s: %v\n", t.Id, err)
+		u.node.emit(Error{Kind: STORAGE_ERROR, PeerId: peerId, TransferId: t.Id, Message: err.Error()})
+		return "", nil, err
+	}
+	return t.Id, session.tokens, nil
+}
+
+// Check the files before anything touches the disk
+func (u *uploadReceiver) newSession(
+	peerId string, senderName string, files []offeredFile) (*uploadSession, []FilePreview, error) {
+	t := &Transfer{
+		Sender:     peerId,
+		SenderName: senderName,
+		Id:         uuid.NewString(),
+		Files:      make(map[string]*File),
+		emit:       u.node.emit,
+		progress:   &progressTracker{},
+	}
+	ctx, cancel := context.WithCancel(u.node.ctx)
+	session := &uploadSession{
+		transfer: t, files: make(map[string]string), tokens: make(map[string]string),
+		uploaded: make(map[string]bool), ctx: ctx, cancel: cancel}
+
+	if len(files) == 0 {
+		return session, nil, errors.New("no files")
+	}
+	previews := []FilePreview{}
+	names := make(map[string]bool)
+	for _, f := range files {
+		name, err := sanitizePath(f.Name)
+		if err != nil {
+			return session, nil, err
+		}
+		folded := strings.ToLower(name) // for case insensitive filesystems
+		if names[folded] || session.files[f.Id] != "" {
+			return session, nil, fmt.Errorf("%q appears more than once", name)
+		}
+		names[folded] = true
+		if f.Size < 0 {
+			return session, nil, fmt.Errorf("%q has an invalid size", name)
+		}
+
+		t.Files[name] = &File{Name: name, Size: f.Size, Kind: REGULAR_FILE}
+		session.files[f.Id] = name
+		previews = append(previews, FilePreview{
+			Name: name, Size: f.Size, Kind: REGULAR_FILE, MimeType: f.MimeType})
+	}
+	slices.SortFunc(previews, func(a, b FilePreview) int { return cmp.Compare(a.Name, b.Name) })
+	return session, previews, nil
+}
+
+// Make room for the files the user accepted, all of them if accepted is empty
+func (u *uploadReceiver) open(session *uploadSession, accepted []string) error {
+	t := session.transfer
+	for id, name := range session.files {
+		if len(accepted) > 0 && !slices.Contains(accepted, name) {
+			delete(session.files, id)
+			delete(t.Files, name)
+			continue
+		}
+		token := make([]byte, 16)
+		rand.Read(token)
+		session.tokens[id] = hex.EncodeToString(token)
+	}
+
+	for _, f := range t.Files {
+		f.Name = path.Join(*u.node.receiver.downloadFolder, f.Name)
+		if err := createEntry(f, *u.node.receiver.downloadFolder); err != nil {
+			removeEntries(t)
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	u.sessions[t.Id] = session
+	session.idle = time.AfterFunc(u.idleTimeout, func() { u.expire(t.Id) })
+	u.mu.Unlock()
+	return nil
+}
+
+// Give up on a sender that stopped uploading, like a browser that was closed
+func (u *uploadReceiver) expire(transferId string) {
+	sender, exists := u.discard(transferId)
+	if !exists {
+		return
+	}
+	log.Printf("Discarding the upload %s, nothing was sent for a while\n", transferId)
+	u.node.emit(TransferFailed{
+		TransferId: transferId, PeerId: sender, Reason: "the sender stopped uploading"})
+}
+
+// Save a file as it's uploaded, finishing the transfer once it has all its files.
+// interrupt is called to unblock reading the body if the session is discarded.
+func (u *uploadReceiver) receive(
+	sessionId string, fileId string, token string, body io.Reader, interrupt func()) error {
+	u.mu.Lock()
+	session, exists := u.sessions[sessionId]
+	u.mu.Unlock()
+	if !exists {
+		return errUnknownSession
+	}
+	expected, exists := session.tokens[fileId]
+	if !exists || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return errInvalidToken
+	}
+
+	t := session.transfer
+	stop := context.AfterFunc(session.ctx, interrupt)
+	err := session.write(t.Files[session.files[fileId]], body, u.idleTimeout)
+	stop()
+	if err != nil {
+		if session.ctx.Err() != nil {
+			// discarded while the file was open, which can keep it from being removed
+			removeEntries(t)
+			return session.ctx.Err()
+		}
+		u.discard(t.Id)
+		u.node.emit(TransferFailed{
+			TransferId: t.Id, PeerId: t.Sender,
+			Reason: fmt.Sprintf("the upload failed: %v", err)})
+		return err
+	}
+
+	session.mu.Lock()
+	session.uploaded[fileId] = true
+	done := len(session.uploaded) == len(session.tokens)
+	if done {
+		t.reportProgress(false, true)
+	}
+	session.mu.Unlock()
+	if !done {
+		return nil
+	}
+
+	// only once, even if the last two files finish together
+	u.mu.Lock()
+	_, exists = u.sessions[t.Id]
+	delete(u.sessions, t.Id)
+	u.mu.Unlock()
+	if exists {
+		session.idle.Stop()
+		session.cancel()
+		u.node.emit(TransferCompleted{
+			TransferId: t.Id, PeerId: t.Sender, SenderName: t.SenderName, Files: len(t.Files)})
+	}
+	return nil
+}
+
+// Write a file to disk as it comes in, putting off the idle timeout while it does
+func (s *uploadSession) write(f *File, body io.Reader, idleTimeout time.Duration) error {
+	s.mu.Lock()
+	done := f.doneReceiving
+	s.mu.Unlock()
+	if done {
+		return nil // like empty files, which are created up front
+	}
+
+	// the file createEntry made, which nobody else had
+	file, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	written := int64(0)
+	buffer := make([]byte, chunkSize)
+	for {
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		n, err := body.Read(buffer)
+		s.idle.Reset(idleTimeout)
+		if written+int64(n) > f.Size {
+			return fmt.Errorf("%s is bigger than the sender said", path.Base(f.Name))
+		}
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return err
+			}
+			written += int64(n)
+			s.mu.Lock()
+			f.received = []Range{{0, written}}
+			s.transfer.reportProgress(false, false)
+			s.mu.Unlock()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if written != f.Size {
+		return fmt.Errorf("%s is smaller than the sender said", path.Base(f.Name))
+	}
+	s.mu.Lock()
+	f.doneReceiving = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (u *uploadReceiver) has(transferId string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, exists := u.sessions[transferId]
+	return exists
+}
+
+// Stop receiving files, throwing away what we got. There's no way to
+// tell the sender, it'll find out when its uploads are refused.
+// Returns who was sending them, if anyone.
+func (u *uploadReceiver) discard(transferId string) (string, bool) {
+	u.mu.Lock()
+	session, exists := u.sessions[transferId]
+	delete(u.sessions, transferId)
+	u.mu.Unlock()
+	if !exists {
+		return "", false
+	}
+	session.idle.Stop()
+	session.cancel()
+	removeEntries(session.transfer)
+	return session.transfer.Sender, true
+}
+
+// Make a blocked read of a request's body return, for when nobody's sending it anymore
+func interruptBody(w http.ResponseWriter) func() {
+	return func() { http.NewResponseController(w).SetReadDeadline(time.Now()) }
+}
+
+// Answer a failed upload with a fitting status
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownSession):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidToken), errors.Is(err, errDeclined):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, context.Canceled):
+		http.Error(w, "cancelled", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadsKeepExistingFiles(t *testing.T) {
+	n := newTestNode(t)
+	existing := filepath.Join(*n.receiver.downloadFolder, "notes.txt")
+	if err := os.WriteFile(existing, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(body string) error {
+		files := []offeredFile{{Id: "notes", Name: "notes.txt", Size: 5}}
+		session, _, err := n.uploads.newSession("peer", "sender", files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.uploads.open(session, nil); err != nil {
+			t.Fatal(err)
+		}
+		id := session.transfer.Id
+		return n.uploads.receive(id, "notes", session.tokens["notes"], strings.NewReader(body), func() {})
+	}
+	unchanged := func() {
+		t.Helper()
+		if contents, err := os.ReadFile(existing); err != nil || string(contents) != "mine" {
+			t.Fatalf("the existing file was changed: %q, %v", contents, err)
+		}
+	}
+	received := filepath.Join(*n.receiver.downloadFolder, "notes (1).txt")
+
+	if err := upload("far too long"); err == nil {
+		t.Fatal("an upload bigger than it said it was was saved")
+	}
+	unchanged()
+	if _, err := os.Stat(received); !os.IsNotExist(err) {
+		t.Fatal("the failed upload was left behind")
+	}
+
+	if err := upload("hello"); err != nil {
+		t.Fatal(err)
+	}
+	unchanged()
+	if contents, err := os.ReadFile(received); err != nil || string(contents) != "hello" {
+		t.Fatalf("the upload was saved as %q, %v", contents, err)
+	}
+}
+
+func TestIdleUploadsAreDiscarded(t *testing.T) {
+	n := newTestNode(t)
+	n.uploads.idleTimeout = 50 * time.Millisecond
+	files := []offeredFile{{Id: "notes", Name: "notes.txt", Size: 5}}
+	session, _, err := n.uploads.newSession("peer", "sender", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.uploads.open(session, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// send part of the file, then stop
+	reader, writer := io.Pipe()
+	go writer.Write([]byte("he"))
+	id := session.transfer.Id
+	if err := n.uploads.receive(id, "notes", session.tokens["notes"], reader,
+		func() { reader.Close() }); err == nil {
+		t.Fatal("a stalled upload was saved")
+	}
+	if failed := nextEvent[TransferFailed](t, n); failed.TransferId != id {
+		t.Fatalf("failed %s instead of %s", failed.TransferId, id)
+	}
+	if n.uploads.has(id) {
+		t.Fatal("the session is still there")
+	}
+	if _, err := os.Stat(filepath.Join(*n.receiver.downloadFolder, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatal("the partial upload was left behind")
+	}
+}
+
+// A browser that's closed partway through uploading a file
+func TestInterruptedBrowserUpload(t *testing.T) {
+	n := newTestNode(t)
+	link, err := n.ShareFiles(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.StopSharing()
+	base, _ := url.Parse(link.Url)
+
+	offered := make(chan *http.Response)
+	go func() {
+		body := strings.NewReader(`[{"Id": "notes", "Name": "notes.txt", "Size": 5}]`)
+		response, err := http.Post(link.Url+"offer", "application/json", body)
+		if err != nil {
+			t.Error(err)
+		}
+		offered <- response
+	}()
+	request := nextEvent[TransferRequested](t, n)
+	n.RespondToRequest(request.TransferId, true)
+	response := <-offered
+	var session struct {
+		Session string
+		Tokens  map[string]string
+	}
+	json.NewDecoder(response.Body).Decode(&session)
+	response.Body.Close()
+
+	conn, err := net.Dial("tcp", base.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "PUT %supload?session=%s&file=notes&token=%s HTTP/1.1\r\n"+
+		"Host: %s\r\nContent-Length: 5\r\n\r\nhe",
+		base.Path, session.Session, session.Tokens["notes"], base.Host)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	if failed := nextEvent[TransferFailed](t, n); failed.TransferId != session.Session {
+		t.Fatalf("failed %s instead of %s", failed.TransferId, session.Session)
+	}
+	if n.uploads.has(session.Session) {
+		t.Fatal("the session is still there")
+	}
+	if _, err := os.Stat(filepath.Join(*n.receiver.downloadFolder, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatal("the partial upload was left behind")
+	}
+}
@@ -2,7 +2,6 @@ package p2p
 
 import (
 	"encoding/json"
-	"fmt"
 	"net"
 	"os"
 
@@ -19,28 +18,25 @@ type Message struct {
 func NewMessage[T any](messageType int, value T) Message {
 	encoded, err := json.Marshal(value)
 	if err != nil {
-		panic(err)
+		panic(err) // only values that can't be json are a problem, which is a bug
 	}
 	return Message{
 		Type:   messageType,
 		Data:   encoded,
-		Sender: deviceName(),
+		Sender: deviceId(),
 	}
 }
 
-func GetMessage(bytes []byte) Message {
+func GetMessage(bytes []byte) (Message, error) {
 	m := Message{}
 	err := json.Unmarshal(bytes, &m)
-	if err != nil {
-		panic(err)
-	}
-	return m
+	return m, err
 }
 
 func (m *Message) Serialize() []byte {
 	bytes, err := json.Marshal(m)
 	if err != nil {
-		panic(err)
+		panic(err) // a message's fields can always be encoded
 	}
 	return bytes
 }
@@ -51,35 +47,15 @@ func Deserialize[T any](msg Message) (T, error) {
 	return result, err
 }
 
-func deviceIP() net.IP {
-	// get the prefered outbound ip address of this device
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		panic(err) // getting the ip is a must
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP
-}
-
-func deviceName() string {
-	name, err := os.Hostname()
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprintf("%s-%d", name, os.Getpid())
-}
-
-func getUnusedPort() int {
+func getUnusedPort() (int, error) {
 	// get the os to give a random free port
 	addr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer conn.Close()
-	return conn.LocalAddr().(*net.UDPAddr).Port
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
 }
 
 func fallocate(file *os.File, offset int64, length int64) error {
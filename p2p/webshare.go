@@ -0,0 +1,308 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sharing with devices that don't have drip, through a web page on our
+// network. The page lists the files being shared and has a form for
+// uploading files to us, which are asked about like any other transfer.
+// Anyone with the link can use it until it expires, so the link has a
+// random token in it, and there's only ever one.
+
+const defaultShareExpiry = 30 * time.Minute
+
+// Where a browser can find the files, usually shown as a qr code
+type ShareLink struct {
+	Url     string
+	Expires time.Time
+}
+
+type webShare struct {
+	link   ShareLink
+	token  string
+	files  map[string]*File // only regular files
+	server *http.Server
+	timer  *time.Timer
+}
+
+// Serve files to browsers until the link expires or StopSharing is
+// called, replacing the previous link. Files can be empty, to only
+// receive files. The node takes ownership of the files.
+func (n *Node) ShareFiles(files map[string]*File, expiry time.Duration) (ShareLink, error) {
+	n.StopSharing()
+	if expiry <= 0 {
+		expiry = defaultShareExpiry
+	}
+
+	s := &webShare{files: make(map[string]*File)}
+	for name, f := range files {
+		if f.Kind != REGULAR_FILE {
+			f.closeReader()
+			continue // folders come along with the files in them
+		}
+		s.files[name] = f
+	}
+	for _, f := range s.files {
+		// downloads can ask for any part of the file
+		if _, seekable := f.reader.(io.ReaderAt); !seekable && f.sourcePath == "" {
+			if err := f.spool(); err != nil {
+				s.closeFiles()
+				return ShareLink{}, err
+			}
+		}
+	}
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	s.token = hex.EncodeToString(secret)
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		s.closeFiles()
+		return ShareLink{}, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	host := net.JoinHostPort(localIPs()[0].String(), strconv.Itoa(port))
+	s.link = ShareLink{
+		Url:     fmt.Sprintf("http://%s/%s/", host, s.token),
+		Expires: time.Now().Add(expiry),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{token}/{$}", func(w http.ResponseWriter, r *http.Request) {
+		n.showSharePage(s, w)
+	})
+	mux.HandleFunc("GET /{token}/files/{name...}", s.download)
+	mux.HandleFunc("POST /{token}/offer", func(w http.ResponseWriter, r *http.Request) {
+		n.handleBrowserOffer(w, r)
+	})
+	mux.HandleFunc("PUT /{token}/upload", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		err := n.uploads.receive(query.Get("session"), query.Get("file"), query.Get("token"),
+			r.Body, interruptBody(w))
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s.server = &http.Server{Handler: s.guard(mux)}
+
+	go func() {
+		if err := s.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to serve the share link: %v\n", err)
+		}
+	}()
+	s.timer = time.AfterFunc(expiry, func() {
+		n.mu.Lock()
+		current := n.share == s
+		if current {
+			n.share = nil
+		}
+		n.mu.Unlock()
+		if current {
+			s.close()
+			n.emit(ShareExpired{Url: s.link.Url})
+		}
+	})
+
+	n.mu.Lock()
+	n.share = s
+	n.mu.Unlock()
+	return s.link, nil
+}
+
+// Take down the share link, if there is one
+func (n *Node) StopSharing() {
+	n.mu.Lock()
+	s := n.share
+	n.share = nil
+	n.mu.Unlock()
+	if s != nil {
+		s.timer.Stop()
+		s.close()
+	}
+}
+
+func (s *webShare) close() {
+	s.server.Close()
+	s.closeFiles()
+}
+
+func (s *webShare) closeFiles() {
+	for _, f := range s.files {
+		f.closeReader()
+	}
+}
+
+// Act like nothing's there unless the link has the right token and hasn't expired
+func (s *webShare) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		valid := subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+		if !valid || time.Now().After(s.link.Expires) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer") // keep the token to ourselves
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *webShare) download(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	f, exists := s.files[name]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	reader, done, err := f.openReader()
+	if err != nil {
+		http.Error(w, "couldn't read the file", http.StatusInternalServerError)
+		return
+	}
+	defer done()
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)})
+	w.Header().Set("Content-Disposition", disposition)
+	http.ServeContent(w, r, path.Base(name), f.ModTime, io.NewSectionReader(reader, 0, f.Size))
+}
+
+// A browser wants to upload files, which waits until the user answers
+// or the browser gives up. The answer has a token for each accepted file.
+func (n *Node) handleBrowserOffer(w http.ResponseWriter, r *http.Request) {
+	var files []offeredFile
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&files)
+	if err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	ip := remoteIp(r)
+	sessionId, tokens, err := n.uploads.request(
+		r.Context(), "browser-"+ip.String(), fmt.Sprintf("a browser at %s", ip), files)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Session string            `json:"session"`
+		Tokens  map[string]string `json:"tokens"`
+	}{sessionId, tokens})
+}
+
+func (n *Node) showSharePage(s *webShare, w http.ResponseWriter) {
+	type sharedFile struct{ Name, Link, Size string }
+	files := []sharedFile{}
+	for name, f := range s.files {
+		link := "files/" + (&url.URL{Path: name}).EscapedPath()
+		files = append(files, sharedFile{name, link, FormatBytes(float64(f.Size))})
+	}
+	slices.SortFunc(files, func(a, b sharedFile) int { return strings.Compare(a.Name, b.Name) })
+
+	n.mu.Lock()
+	name := n.displayName
+	n.mu.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := sharePage.Execute(w, struct {
+		Name    string
+		Files   []sharedFile
+		Expires string
+	}{name, files, s.link.Expires.Format("15:04")})
+	if err != nil {
+		log.Printf("Failed to show the share page: %v\n", err)
+	}
+}
+
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}} on drip</title>
+<style>
+  body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+  li { margin: 0.4em 0; }
+  .size, .note { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p class="note">This link works until {{.Expires}}.</p>
+
+{{if .Files}}
+<h2>Download</h2>
+<ul>
+{{range .Files}}<li><a href="{{.Link}}" download>{{.Name}}</a> <span class="size">{{.Size}}</span></li>
+{{end}}</ul>
+{{end}}
+
+<h2>Send files to {{.Name}}</h2>
+<form id="upload">
+  <input type="file" id="files" multiple>
+  <button type="submit">Send</button>
+</form>
+<p id="status"></p>
+
+<script>
+const form = document.getElementById("upload");
+const input = document.getElementById("files");
+const status = document.getElementById("status");
+
+form.addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const files = Array.from(input.files);
+  if (files.length == 0) return;
+  form.querySelector("button").disabled = true;
+
+  try {
+    status.textContent = "Waiting for {{.Name}} to accept...";
+    const offer = files.map((f, i) => ({ id: String(i), name: f.name, size: f.size, mimeType: f.type }));
+    const response = await fetch("offer", { method: "POST", body: JSON.stringify(offer) });
+    if (response.status == 403) throw new Error("{{.Name}} declined the files");
+    if (!response.ok) throw new Error(await response.text());
+    const answer = await response.json();
+
+    const accepted = files.filter((f, i) => answer.tokens[String(i)] !== undefined);
+    let sent = 0;
+    for (const [i, file] of files.entries()) {
+      const token = answer.tokens[String(i)];
+      if (token === undefined) continue;
+      status.textContent = "Sending " + file.name + " (" + (sent + 1) + " of " + accepted.length + ")";
+      const query = new URLSearchParams({ session: answer.session, file: String(i), token: token });
+      const upload = await fetch("upload?" + query, { method: "PUT", body: file });
+      if (!upload.ok) throw new Error("couldn't send " + file.name + ": " + await upload.text());
+      sent++;
+    }
+    status.textContent = "Sent " + sent + (sent == 1 ? " file" : " files");
+  } catch (err) {
+    status.textContent = err.message;
+  } finally {
+    form.querySelector("button").disabled = false;
+    form.reset();
+  }
+});
+</script>
+</body>
+</html>
+`))
@@ -6,17 +6,46 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gioui.org/app"
 	"gioui.org/widget"
+	"github.com/aabiji/drip/p2p"
 )
 
 type Settings struct {
-	DownloadPath string
-	TrustPeers   widget.Bool
-	NotifyUser   widget.Bool
-	DarkMode     widget.Bool
-	path         string
+	DisplayName    string
+	DownloadPath   string
+	TrustPeers     widget.Bool
+	NotifyUser     widget.Bool
+	DarkMode       widget.Bool
+	FollowSymlinks widget.Bool // for symlinks in folders being sent
+	LanOnly        widget.Bool // never contact anything outside the local network
+	ICEServers     string      // comma separated stun and turn urls
+	Port           int         // fixed so that other devices can list our address
+	StaticPeers    []string    // host:port addresses of devices to look for directly
+	UploadLimit    int         // KB/s shared by every device, 0 for no limit
+	PeerLimit      int         // KB/s for each device, 0 for no limit
+	LimitWorkHours widget.Bool // only limit uploads on weekdays from 9 to 5
+	ControlAPI     widget.Bool // let scripts on this machine drive the app
+	LocalSend      widget.Bool // also send to and receive from LocalSend apps
+	ControlPort    int         // where the control api listens, picked at random if 0
+	path           string
+}
+
+// How fast the node may send files
+func (s *Settings) rateLimits() p2p.RateLimits {
+	global, perPeer := int64(s.UploadLimit)*1000, int64(s.PeerLimit)*1000
+	if !s.LimitWorkHours.Value {
+		return p2p.RateLimits{Global: global, PerPeer: perPeer}
+	}
+
+	// full speed outside of working hours
+	weekdays := []time.Weekday{
+		time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	workHours := p2p.ScheduleRule{
+		Days: weekdays, Start: 9 * 60, End: 17 * 60, Global: global, PerPeer: perPeer}
+	return p2p.RateLimits{Schedule: []p2p.ScheduleRule{workHours}}
 }
 
 func saveSettings(s Settings) {
@@ -47,6 +76,8 @@ func loadSettings() Settings {
 		TrustPeers:   widget.Bool{Value: true},
 		NotifyUser:   widget.Bool{Value: true},
 		DownloadPath: defaultFolder,
+		DisplayName:  p2p.DefaultDisplayName(),
+		ICEServers:   p2p.DefaultICEServers,
 		path:         configPath,
 	}
 
@@ -66,5 +97,8 @@ func loadSettings() Settings {
 	if len(strings.TrimSpace(settings.DownloadPath)) == 0 {
 		settings.DownloadPath = defaultFolder
 	}
+	if len(strings.TrimSpace(settings.DisplayName)) == 0 {
+		settings.DisplayName = p2p.DefaultDisplayName()
+	}
 	return settings
 }
@@ -2,11 +2,14 @@ package main
 
 import (
 	"fmt"
+	"image"
 	"io"
 	"io/fs"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +21,7 @@ import (
 	"gioui.org/x/explorer"
 	"github.com/aabiji/drip/p2p"
 	"golang.org/x/exp/shiny/materialdesign/icons"
+	"rsc.io/qr"
 )
 
 const (
@@ -25,6 +29,9 @@ const (
 	SETTINGS_PAGE
 	PROGRESS_PAGE
 	PICKER_PAGE
+	RECEIVING_PAGE
+	SHARE_PAGE
+	ADD_PEER_PAGE
 )
 
 const (
@@ -33,11 +40,16 @@ const (
 	UPLOAD_ICON
 	CLOSE_ICON
 	CHECK_ICON
+	COMPUTER_ICON
+	PHONE_ICON
+	SERVER_ICON
 )
 
 const (
 	BTNS_START = iota
 	UPLOAD_BTN
+	FOLDER_BTN
+	PAIR_BTN
 	SEND_BTN
 	THEME_BTN
 	PATH_BTN
@@ -46,13 +58,41 @@ const (
 	SELECT_BTN
 	ACCEPT_BTN
 	DENY_BTN
+	PAUSE_BTN
+	STOP_BTN
+	SHARE_BTN
+	UNSHARE_BTN
+	ADD_PAGE_BTN
+	ADD_PEER_BTN
 	BTNS_END
 )
 
+const ( // events the ui sends to the app
+	SEND_FILES       = iota
+	CANCEL_TRANSFER  // with whether it's the transfers being received
+	PAUSE_TRANSFER   // likewise
+	UNPAUSE_TRANSFER // likewise
+	SET_RATE_LIMITS
+	RENAME_DEVICE
+	PAIR_DEVICE // with the peer id
+	AUTH_GRANTED
+	SHARE_FILES
+	STOP_SHARING
+	SHOW_PAIRING_CODE
+	ADD_PEER // with an address or pairing code
+)
+
+type UIEvent struct {
+	Type  int
+	Value any
+}
+
 type C = layout.Context
 type D = layout.Dimensions
 
 type Item struct {
+	id        string       // set for recipients
+	peer      p2p.PeerInfo // likewise
 	name      string
 	clickable widget.Clickable
 	check     widget.Bool
@@ -61,12 +101,15 @@ type Item struct {
 	rc       io.ReadCloser
 	size     int64
 	progress float32
+	path     string // set for folders, which are sent as a whole
+
+	thumbnail paint.ImageOp // set for images in a transfer request
 }
 
 type UI struct {
 	settings  *Settings
 	isAndroid bool
-	appEvents chan p2p.Message
+	events    chan UIEvent
 	picker    *explorer.Explorer
 	styles    Styles
 
@@ -76,42 +119,79 @@ type UI struct {
 	folders        []Item
 	filesList      *widget.List
 	files          []Item
-
-	errors  []Item
-	icons   []*widget.Icon
-	buttons []widget.Clickable
-
-	currentPage   int
-	authMsg       string
-	showAuthPopup bool
-	sendingMsg    string
-	sendingDone   bool
+	incomingList   *widget.List
+	incoming       []Item // files being received, id is the transfer id
+	requestList    *widget.List
+	requestFiles   []Item // files offered in the request being shown
+
+	errors       []Item
+	icons        []*widget.Icon
+	buttons      []widget.Clickable
+	nameEditor   widget.Editor
+	iceEditor    widget.Editor
+	limitEditors [2]widget.Editor // the upload limit for every device, and for each one
+
+	currentPage     int
+	pickerPath      string // the folder being browsed in the folder picker
+	pickingFolder   bool   // picking a folder to send rather than a download path
+	authMsg         string
+	showAuthPopup   bool
+	sendingMsg      string
+	sendingDone     bool
+	sendingPaused   bool
+	receivingMsg    string
+	receivingDone   bool
+	receivingPaused bool
+
+	shareLink p2p.ShareLink
+	shareCode paint.ImageOp // the link as a qr code
+
+	peerEditor  widget.Editor // an address or pairing code to add a device with
+	pairingCode string        // ours, for other devices to add us with
+	pairingQR   paint.ImageOp
 }
 
-func NewUI(s *Settings, appEvents chan p2p.Message, isAndroid bool) *UI {
+func NewUI(s *Settings, events chan UIEvent, isAndroid bool) *UI {
 	ui := &UI{
-		appEvents: appEvents,
+		events: events,
 		recipientsList: &widget.List{
 			List: layout.List{Axis: layout.Vertical}},
 		filesList: &widget.List{
 			List: layout.List{Axis: layout.Vertical}},
 		foldersList: &widget.List{
 			List: layout.List{Axis: layout.Vertical}},
+		incomingList: &widget.List{
+			List: layout.List{Axis: layout.Vertical}},
+		requestList: &widget.List{
+			List: layout.List{Axis: layout.Vertical}},
 		buttons:     make([]widget.Clickable, BTNS_END-BTNS_START),
 		currentPage: HOME_PAGE,
 		settings:    s,
 		styles:      NewStyles(s.DarkMode.Value),
 		isAndroid:   isAndroid,
+		nameEditor:  widget.Editor{SingleLine: true, Submit: true},
+		peerEditor:  widget.Editor{SingleLine: true, Submit: true},
+		iceEditor:   widget.Editor{SingleLine: true, Submit: true},
+		limitEditors: [2]widget.Editor{
+			{SingleLine: true, Submit: true, Filter: "0123456789"},
+			{SingleLine: true, Submit: true, Filter: "0123456789"},
+		},
 	}
+	ui.nameEditor.SetText(s.DisplayName)
+	ui.iceEditor.SetText(s.ICEServers)
+	ui.limitEditors[0].SetText(limitText(s.UploadLimit))
+	ui.limitEditors[1].SetText(limitText(s.PeerLimit))
 
 	if !isAndroid {
+		ui.pickerPath = s.DownloadPath
 		ui.setupFolderList()
 	}
 
 	iconBytes := [][]byte{
 		icons.NavigationArrowBack, icons.ActionSettings,
 		icons.FileFileUpload, icons.NavigationClose,
-		icons.NavigationCheck}
+		icons.NavigationCheck, icons.HardwareComputer,
+		icons.HardwareSmartphone, icons.ActionDNS}
 	for _, data := range iconBytes {
 		icon, err := widget.NewIcon(data)
 		if err != nil {
@@ -122,13 +202,20 @@ func NewUI(s *Settings, appEvents chan p2p.Message, isAndroid bool) *UI {
 	return ui
 }
 
-func (ui *UI) UpdateRecipients(recipient string, remove bool) {
+func (ui *UI) UpdateRecipients(peer p2p.PeerInfo, remove bool) {
 	// TODO: get the UI to immediately update
 	if !remove {
-		ui.recipients = append(ui.recipients, Item{name: recipient})
+		for i := range ui.recipients {
+			if ui.recipients[i].id == peer.Id { // it was renamed or updated
+				ui.recipients[i].name = peer.Name
+				ui.recipients[i].peer = peer
+				return
+			}
+		}
+		ui.recipients = append(ui.recipients, Item{id: peer.Id, name: peer.Name, peer: peer})
 	} else {
 		for i := 0; i < len(ui.recipients); i++ {
-			if ui.recipients[i].name == recipient {
+			if ui.recipients[i].id == peer.Id {
 				ui.recipients = append(ui.recipients[:i], ui.recipients[i+1:]...)
 				break
 			}
@@ -136,19 +223,172 @@ func (ui *UI) UpdateRecipients(recipient string, remove bool) {
 	}
 }
 
-func (ui *UI) UpdateFileProgresses(percentages map[string]float32) {
+func (ui *UI) UpdateFileProgresses(progresses map[string]p2p.Progress) {
 	for i := 0; i < len(ui.files); i++ {
 		name := ui.files[i].name
-		ui.files[i].progress = percentages[name]
+		if ui.files[i].path == "" {
+			ui.files[i].progress = progresses[name].Fraction()
+			continue
+		}
+
+		// a folder's progress is everything in it put together
+		var done, total int64
+		for entry, p := range progresses {
+			if entry == name || strings.HasPrefix(entry, name+"/") {
+				done += p.BytesDone
+				total += p.BytesTotal
+			}
+		}
+		ui.files[i].progress = p2p.Progress{BytesDone: done, BytesTotal: total}.Fraction()
+	}
+}
+
+// Show how far along the files we're receiving are,
+// switching to the receiving page when a transfer starts
+func (ui *UI) UpdateIncoming(transferId string, sender string, report p2p.ProgressReport) {
+	names := []string{}
+	for name := range report.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	ui.ForgetIncoming(transferId)
+	for _, name := range names {
+		ui.incoming = append(ui.incoming, Item{
+			id: transferId, name: name, progress: report.Files[name].Fraction(),
+		})
+	}
+
+	ui.receivingDone = report.Done
+	ui.receivingPaused = report.Paused
+	switch {
+	case report.Done:
+		ui.receivingMsg = "Done receiving files"
+		return
+	case report.Paused:
+		ui.receivingMsg = "Paused"
+	case report.PausedByPeer:
+		ui.receivingMsg = fmt.Sprintf("Paused by %s", sender)
+	default:
+		ui.receivingMsg = fmt.Sprintf("Receiving from %s", sender)
+		if stats := describeProgress(report.Progress); stats != "" {
+			ui.receivingMsg += " · " + stats
+		}
+	}
+	if ui.currentPage == HOME_PAGE && !ui.showAuthPopup {
+		ui.currentPage = RECEIVING_PAGE
+	}
+}
+
+// List the files offered in a transfer request, all of them checked to start
+func (ui *UI) SetRequestFiles(previews []p2p.FilePreview) {
+	ui.requestFiles = []Item{}
+	for _, preview := range previews {
+		item := Item{name: preview.Name, size: preview.Size}
+		if preview.Kind == p2p.DIRECTORY {
+			item.name += "/"
+		}
+		item.check.Value = true
+
+		if preview.Thumbnail != nil {
+			img, err := preview.DecodeThumbnail()
+			if err == nil {
+				item.thumbnail = paint.NewImageOp(img)
+			}
+		}
+		ui.requestFiles = append(ui.requestFiles, item)
+	}
+}
+
+// The names of the offered files the user kept checked, and whether that's all of them
+func (ui *UI) acceptedFiles() ([]string, bool) {
+	accepted := []string{}
+	for _, item := range ui.requestFiles {
+		if item.check.Value {
+			accepted = append(accepted, strings.TrimSuffix(item.name, "/"))
+		}
 	}
+	return accepted, len(accepted) == len(ui.requestFiles)
+}
+
+// The transfers shown on the receiving page
+func (ui *UI) incomingTransfers() []string {
+	ids := []string{}
+	for _, item := range ui.incoming {
+		if !slices.Contains(ids, item.id) {
+			ids = append(ids, item.id)
+		}
+	}
+	return ids
+}
+
+func (ui *UI) ForgetIncoming(transferId string) {
+	ui.incoming = slices.DeleteFunc(ui.incoming, func(item Item) bool {
+		return item.id == transferId
+	})
+}
+
+// Get the name the user gave a peer's device
+func (ui *UI) PeerName(id string) string {
+	for _, peer := range ui.recipients {
+		if peer.id == id {
+			return peer.name
+		}
+	}
+	return id
 }
 
 func (ui *UI) AddError(err string) { ui.errors = append(ui.errors, Item{name: err}) }
 
+func qrImage(text string) (paint.ImageOp, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return paint.ImageOp{}, err
+	}
+	img := paint.NewImageOp(code.Image())
+	img.Filter = paint.FilterNearest // keep the modules sharp when scaled
+	return img, nil
+}
+
+// Show the link browsers can open. The selected files now belong to the share.
+func (ui *UI) ShowShareLink(link p2p.ShareLink) error {
+	code, err := qrImage(link.Url)
+	if err != nil {
+		return err
+	}
+	ui.shareLink = link
+	ui.shareCode = code
+	ui.files = []Item{}
+	ui.currentPage = SHARE_PAGE
+	return nil
+}
+
+// Show our pairing code next to the form for adding a device
+func (ui *UI) ShowPairingCode(payload string) error {
+	code, err := qrImage(payload)
+	if err != nil {
+		return err
+	}
+	ui.pairingCode = payload
+	ui.pairingQR = code
+	ui.currentPage = ADD_PEER_PAGE
+	return nil
+}
+
+func (ui *UI) addPeer() {
+	value := strings.TrimSpace(ui.peerEditor.Text())
+	if value == "" {
+		return
+	}
+	ui.peerEditor.SetText("")
+	ui.currentPage = HOME_PAGE
+	ui.events <- UIEvent{Type: ADD_PEER, Value: value}
+}
+
 func (ui *UI) ForgetCurrentTransfer(cancel bool, empty bool) {
 	ui.currentPage = HOME_PAGE
 	if cancel {
-		ui.appEvents <- p2p.NewMessage(p2p.TRANSFER_CANCELLED, "")
+		ui.events <- UIEvent{Type: CANCEL_TRANSFER}
 	}
 	if !empty {
 		return
@@ -159,15 +399,95 @@ func (ui *UI) ForgetCurrentTransfer(cancel bool, empty bool) {
 	ui.files = []Item{}
 }
 
-func (ui *UI) sendBtnDisabled() bool {
-	noPeersSelected := true
+func (ui *UI) selectedRecipients() []string {
+	selected := []string{}
 	for _, peer := range ui.recipients {
 		if peer.check.Value {
-			noPeersSelected = false
-			break
+			selected = append(selected, peer.id)
+		}
+	}
+	return selected
+}
+
+func (ui *UI) renameDevice() {
+	name := strings.TrimSpace(ui.nameEditor.Text())
+	if name == "" || name == ui.settings.DisplayName {
+		return
+	}
+	ui.settings.DisplayName = name
+	ui.events <- UIEvent{Type: RENAME_DEVICE, Value: name}
+}
+
+// the ice servers are used for connections made after a restart
+func (ui *UI) setICEServers() {
+	spec := strings.TrimSpace(ui.iceEditor.Text())
+	if spec == ui.settings.ICEServers {
+		return
+	}
+	if _, err := p2p.ParseICEServers(spec); err != nil {
+		ui.AddError(fmt.Sprintf("Invalid ICE servers: %v", err))
+		return
+	}
+	ui.settings.ICEServers = spec
+}
+
+func limitText(limit int) string {
+	if limit == 0 {
+		return ""
+	}
+	return strconv.Itoa(limit)
+}
+
+// Apply the upload limits once the user is done typing
+func (ui *UI) setRateLimits() {
+	limits := [2]int{}
+	for i := range ui.limitEditors {
+		text := strings.TrimSpace(ui.limitEditors[i].Text())
+		if text == "" {
+			continue // no limit
+		}
+		limit, err := strconv.Atoi(text)
+		if err != nil || limit < 0 {
+			ui.AddError(fmt.Sprintf("Invalid upload limit: %s", text))
+			return
+		}
+		limits[i] = limit
+	}
+	if limits[0] == ui.settings.UploadLimit && limits[1] == ui.settings.PeerLimit {
+		return
+	}
+	ui.settings.UploadLimit, ui.settings.PeerLimit = limits[0], limits[1]
+	ui.events <- UIEvent{Type: SET_RATE_LIMITS}
+}
+
+func (ui *UI) sendBtnDisabled() bool {
+	return len(ui.files) == 0 || len(ui.selectedRecipients()) == 0
+}
+
+// we can only pair with one device at a time, and only if it supports pairing
+func (ui *UI) pairBtnDisabled() bool {
+	if len(ui.selectedRecipients()) != 1 {
+		return true
+	}
+	for _, recipient := range ui.recipients {
+		if recipient.check.Value {
+			return !recipient.peer.Supports(p2p.PAIRING_CAPABILITY)
 		}
 	}
-	return len(ui.files) == 0 || noPeersSelected
+	return true
+}
+
+// The icon for the kind of device a peer is, if it said
+func (ui *UI) deviceIcon(peer p2p.PeerInfo) *widget.Icon {
+	switch peer.DeviceType {
+	case p2p.DESKTOP_DEVICE:
+		return ui.icons[COMPUTER_ICON]
+	case p2p.PHONE_DEVICE:
+		return ui.icons[PHONE_ICON]
+	case p2p.SERVER_DEVICE:
+		return ui.icons[SERVER_ICON]
+	}
+	return nil
 }
 
 func (ui *UI) addFiles() {
@@ -195,6 +515,11 @@ func (ui *UI) addFiles() {
 	}
 }
 
+func (ui *UI) addFolder(folderPath string) {
+	ui.files = append(ui.files, Item{
+		name: filepath.Base(folderPath), path: folderPath, progress: -1})
+}
+
 func isWriteable(folderPath string) bool {
 	temp := filepath.Join(folderPath, ".temp")
 	file, err := os.Create(temp)
@@ -207,15 +532,16 @@ func isWriteable(folderPath string) bool {
 }
 
 func (ui *UI) setupFolderList() {
-	entries, err := os.ReadDir(ui.settings.DownloadPath)
+	entries, err := os.ReadDir(ui.pickerPath)
 	if err != nil {
 		panic(err)
 	}
 
 	ui.folders = nil
 	for _, entry := range entries {
-		fullpath := filepath.Join(ui.settings.DownloadPath, entry.Name())
-		if entry.IsDir() && isWriteable(fullpath) {
+		fullpath := filepath.Join(ui.pickerPath, entry.Name())
+		// folders we're sending only need to be readable
+		if entry.IsDir() && (ui.pickingFolder || isWriteable(fullpath)) {
 			ui.folders = append(ui.folders, Item{name: entry.Name()})
 		}
 	}
@@ -231,11 +557,67 @@ func getCopyright() string {
 }
 
 func (ui *UI) handleInputs(gtx C) {
+	for { // rename the device once the user is done typing
+		event, ok := ui.nameEditor.Update(gtx)
+		if !ok {
+			break
+		}
+		if _, submitted := event.(widget.SubmitEvent); submitted {
+			ui.renameDevice()
+		}
+	}
+	for {
+		event, ok := ui.iceEditor.Update(gtx)
+		if !ok {
+			break
+		}
+		if _, submitted := event.(widget.SubmitEvent); submitted {
+			ui.setICEServers()
+		}
+	}
+
+	for {
+		event, ok := ui.peerEditor.Update(gtx)
+		if !ok {
+			break
+		}
+		if _, submitted := event.(widget.SubmitEvent); submitted {
+			ui.addPeer()
+		}
+	}
+
+	for i := range ui.limitEditors {
+		for {
+			event, ok := ui.limitEditors[i].Update(gtx)
+			if !ok {
+				break
+			}
+			if _, submitted := event.(widget.SubmitEvent); submitted {
+				ui.setRateLimits()
+			}
+		}
+	}
+	if ui.settings.LimitWorkHours.Update(gtx) {
+		ui.events <- UIEvent{Type: SET_RATE_LIMITS}
+	}
+
 	if ui.buttons[PAGE_BTN].Clicked(gtx) { // change the current page
+		if ui.currentPage == SETTINGS_PAGE {
+			ui.renameDevice()
+			ui.setICEServers()
+			ui.setRateLimits()
+		}
 		if ui.currentPage == HOME_PAGE || ui.currentPage == SETTINGS_PAGE {
 			ui.currentPage = (ui.currentPage + 1) % 2
 		} else if ui.currentPage == PROGRESS_PAGE {
 			ui.ForgetCurrentTransfer(!ui.sendingDone, true)
+		} else if ui.currentPage == RECEIVING_PAGE {
+			ui.currentPage = HOME_PAGE
+		} else if ui.currentPage == ADD_PEER_PAGE {
+			ui.currentPage = HOME_PAGE
+		} else if ui.currentPage == SHARE_PAGE {
+			ui.currentPage = HOME_PAGE
+			ui.events <- UIEvent{Type: STOP_SHARING}
 		}
 	}
 
@@ -252,12 +634,55 @@ func (ui *UI) handleInputs(gtx C) {
 	}
 
 	if !ui.sendBtnDisabled() && ui.buttons[SEND_BTN].Clicked(gtx) {
-		ui.appEvents <- p2p.NewMessage(p2p.SEND_FILES, "")
+		ui.events <- UIEvent{Type: SEND_FILES}
+	}
+
+	if ui.buttons[ADD_PAGE_BTN].Clicked(gtx) {
+		ui.events <- UIEvent{Type: SHOW_PAIRING_CODE}
+	}
+
+	if ui.buttons[ADD_PEER_BTN].Clicked(gtx) {
+		ui.addPeer()
+	}
+
+	if ui.buttons[SHARE_BTN].Clicked(gtx) {
+		ui.events <- UIEvent{Type: SHARE_FILES}
+	}
+
+	if ui.buttons[UNSHARE_BTN].Clicked(gtx) {
+		ui.currentPage = HOME_PAGE
+		ui.events <- UIEvent{Type: STOP_SHARING}
+	}
+
+	if !ui.pairBtnDisabled() && ui.buttons[PAIR_BTN].Clicked(gtx) {
+		ui.events <- UIEvent{Type: PAIR_DEVICE, Value: ui.selectedRecipients()[0]}
 	}
 
 	acceptClicked := ui.buttons[ACCEPT_BTN].Clicked(gtx)
 	if acceptClicked || ui.buttons[DENY_BTN].Clicked(gtx) {
-		ui.appEvents <- p2p.NewMessage(p2p.AUTH_GRANTED, acceptClicked)
+		ui.events <- UIEvent{Type: AUTH_GRANTED, Value: acceptClicked}
+	}
+
+	// pausing and cancelling on the progress and receiving pages
+	receiving := ui.currentPage == RECEIVING_PAGE
+	paused := ui.sendingPaused
+	if receiving {
+		paused = ui.receivingPaused
+	}
+	if ui.buttons[PAUSE_BTN].Clicked(gtx) {
+		if paused {
+			ui.events <- UIEvent{Type: UNPAUSE_TRANSFER, Value: receiving}
+		} else {
+			ui.events <- UIEvent{Type: PAUSE_TRANSFER, Value: receiving}
+		}
+	}
+	if ui.buttons[STOP_BTN].Clicked(gtx) {
+		if receiving {
+			ui.currentPage = HOME_PAGE
+			ui.events <- UIEvent{Type: CANCEL_TRANSFER, Value: true}
+		} else {
+			ui.ForgetCurrentTransfer(true, true)
+		}
 	}
 
 	if ui.buttons[UPLOAD_BTN].Clicked(gtx) {
@@ -272,19 +697,32 @@ func (ui *UI) handleInputs(gtx C) {
 	if !ui.isAndroid {
 		for i := 0; i < len(ui.folders); i++ { // navigate folders
 			if ui.folders[i].clickable.Clicked(gtx) {
-				ui.settings.DownloadPath =
-					filepath.Join(ui.settings.DownloadPath, ui.folders[i].name)
+				ui.pickerPath = filepath.Join(ui.pickerPath, ui.folders[i].name)
 				ui.setupFolderList()
 				break
 			}
 		}
 		if ui.buttons[BACK_BTN].Clicked(gtx) {
-			ui.settings.DownloadPath = filepath.Dir(ui.settings.DownloadPath)
+			ui.pickerPath = filepath.Dir(ui.pickerPath)
 			ui.setupFolderList() // navigate one folder back up
 		} else if ui.buttons[SELECT_BTN].Clicked(gtx) {
-			ui.currentPage = SETTINGS_PAGE // close the folder picker
+			// close the folder picker
+			if ui.pickingFolder {
+				ui.addFolder(ui.pickerPath)
+				ui.currentPage = HOME_PAGE
+			} else {
+				ui.settings.DownloadPath = ui.pickerPath
+				ui.currentPage = SETTINGS_PAGE
+			}
 		} else if ui.buttons[PATH_BTN].Clicked(gtx) {
+			ui.pickingFolder = false
+			ui.pickerPath = ui.settings.DownloadPath
+			ui.setupFolderList()
 			ui.currentPage = PICKER_PAGE // show the folder picker
+		} else if ui.buttons[FOLDER_BTN].Clicked(gtx) {
+			ui.pickingFolder = true
+			ui.setupFolderList()
+			ui.currentPage = PICKER_PAGE
 		}
 	}
 }
@@ -335,6 +773,12 @@ func (ui *UI) DrawFrame(gtx C) {
 					return ui.drawHomePage(gtx)
 				case PROGRESS_PAGE:
 					return ui.drawProgressPage(gtx)
+				case RECEIVING_PAGE:
+					return ui.drawReceivingPage(gtx)
+				case SHARE_PAGE:
+					return ui.drawSharePage(gtx)
+				case ADD_PEER_PAGE:
+					return ui.drawAddPeerPage(gtx)
 				default:
 					return ui.drawSettingsPage(gtx)
 				}
@@ -522,6 +966,29 @@ func (ui *UI) drawUploadButton(gtx C) D {
 	})
 }
 
+func (ui *UI) drawRecipient(gtx C, recipient *Item) D {
+	return layout.Flex{
+		Axis:      layout.Horizontal,
+		Alignment: layout.Start,
+	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			icon := ui.deviceIcon(recipient.peer)
+			if icon == nil {
+				return layout.Dimensions{}
+			}
+			return layout.Inset{Right: unit.Dp(10)}.Layout(gtx, func(gtx C) D {
+				size := gtx.Dp(unit.Dp(25))
+				gtx.Constraints = layout.Exact(image.Pt(size, size))
+				return icon.Layout(gtx, ui.styles.fg400)
+			})
+		}),
+		layout.Rigid(func(gtx C) D {
+			return Checkbox(gtx, ui.styles, &recipient.check,
+				ui.icons[CHECK_ICON], recipient.name)
+		}),
+	)
+}
+
 func (ui *UI) drawHomePage(gtx C) D {
 	widgets := []layout.FlexChild{
 		layout.Rigid(func(gtx C) D {
@@ -533,11 +1000,20 @@ func (ui *UI) drawHomePage(gtx C) D {
 			return list.Layout(gtx,
 				len(ui.recipients), func(gtx C, i int) D {
 					gtx.Constraints.Max.Y = gtx.Constraints.Max.Y * 50 / 100
-					return Checkbox(gtx, ui.styles, &ui.recipients[i].check,
-						ui.icons[CHECK_ICON], ui.recipients[i].name)
+					return ui.drawRecipient(gtx, &ui.recipients[i])
 				})
 		}),
 		layout.Rigid(func(gtx C) D { return ui.drawUploadButton(gtx) }),
+		layout.Rigid(func(gtx C) D {
+			// android's folder picker can't be opened from here either
+			if ui.isAndroid {
+				return layout.Dimensions{}
+			}
+			return layout.Inset{Bottom: unit.Dp(12)}.Layout(gtx, func(gtx C) D {
+				return TextButton(gtx, ui.styles, "Select folder", 16,
+					true, false, true, &ui.buttons[FOLDER_BTN])
+			})
+		}),
 	}
 
 	if len(ui.files) > 0 {
@@ -558,6 +1034,27 @@ func (ui *UI) drawHomePage(gtx C) D {
 			return TextButton(gtx, ui.styles, "Send files", 18, false,
 				ui.sendBtnDisabled(), true, &ui.buttons[SEND_BTN])
 		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Spacer{Height: unit.Dp(12)}.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return TextButton(gtx, ui.styles, "Pair with device", 16, false,
+				ui.pairBtnDisabled(), true, &ui.buttons[PAIR_BTN])
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Spacer{Height: unit.Dp(12)}.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D { // for networks discovery doesn't work on
+			return TextButton(gtx, ui.styles, "Add a device", 16, true,
+				false, true, &ui.buttons[ADD_PAGE_BTN])
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Spacer{Height: unit.Dp(12)}.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D { // for devices without drip
+			return TextButton(gtx, ui.styles, "Share via link", 16, true,
+				false, true, &ui.buttons[SHARE_BTN])
+		}),
 	)
 
 	return layout.Flex{
@@ -567,6 +1064,35 @@ func (ui *UI) drawHomePage(gtx C) D {
 	}.Layout(gtx, widgets...)
 }
 
+// Pause or resume and cancel buttons, hidden once the transfer is done
+func (ui *UI) drawTransferControls(gtx C, paused bool, done bool) D {
+	if done {
+		return layout.Dimensions{}
+	}
+	label := "Pause"
+	if paused {
+		label = "Resume"
+	}
+
+	return layout.Inset{Bottom: unit.Dp(20)}.Layout(gtx, func(gtx C) D {
+		return XCentered(gtx, false, func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return TextButton(gtx, ui.styles, label, 15,
+						false, false, true, &ui.buttons[PAUSE_BTN])
+				}),
+				layout.Rigid(func(gtx C) D {
+					return layout.Spacer{Width: unit.Dp(20)}.Layout(gtx)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return TextButton(gtx, ui.styles, "Cancel", 15,
+						true, false, true, &ui.buttons[STOP_BTN])
+				}),
+			)
+		})
+	})
+}
+
 func (ui *UI) drawProgressPage(gtx C) D {
 	return layout.Flex{
 		Alignment: layout.Start,
@@ -582,6 +1108,10 @@ func (ui *UI) drawProgressPage(gtx C) D {
 				})
 		}),
 
+		layout.Rigid(func(gtx C) D {
+			return ui.drawTransferControls(gtx, ui.sendingPaused, ui.sendingDone)
+		}),
+
 		layout.Flexed(0.9, func(gtx C) D {
 			return material.List(ui.styles.theme, ui.filesList).Layout(gtx,
 				len(ui.files), func(gtx C, i int) D {
@@ -591,12 +1121,123 @@ func (ui *UI) drawProgressPage(gtx C) D {
 	)
 }
 
+func (ui *UI) drawReceivingPage(gtx C) D {
+	return layout.Flex{
+		Alignment: layout.Start,
+		Axis:      layout.Vertical,
+		Spacing:   layout.SpaceEvenly,
+	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Bottom: unit.Dp(20)}.Layout(gtx,
+				func(gtx C) D {
+					return XCentered(gtx, false, func(gtx C) D {
+						return Text(gtx, ui.styles, ui.receivingMsg, 40, false)
+					})
+				})
+		}),
+
+		layout.Rigid(func(gtx C) D {
+			return ui.drawTransferControls(gtx, ui.receivingPaused, ui.receivingDone)
+		}),
+
+		layout.Flexed(0.9, func(gtx C) D {
+			return material.List(ui.styles.theme, ui.incomingList).Layout(gtx,
+				len(ui.incoming), func(gtx C, i int) D {
+					return ui.drawFileEntry(gtx, &ui.incoming[i])
+				})
+		}),
+	)
+}
+
+// The share link, for a browser on another device to open
+func (ui *UI) drawSharePage(gtx C) D {
+	expires := fmt.Sprintf("Works until %s", ui.shareLink.Expires.Format("15:04"))
+	return layout.Flex{
+		Axis:      layout.Vertical,
+		Spacing:   layout.SpaceEnd,
+		Alignment: layout.Middle,
+	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Bottom: unit.Dp(20)}.Layout(gtx, func(gtx C) D {
+				return Text(gtx, ui.styles, "Open this link on the other device", 24, false)
+			})
+		}),
+		layout.Rigid(func(gtx C) D {
+			size := min(gtx.Constraints.Max.X, gtx.Dp(unit.Dp(260)))
+			gtx.Constraints = layout.Exact(image.Pt(size, size))
+			return widget.Image{
+				Src: ui.shareCode, Fit: widget.Contain, Position: layout.Center,
+			}.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Top: unit.Dp(20), Bottom: unit.Dp(8)}.Layout(gtx,
+				func(gtx C) D {
+					return Text(gtx, ui.styles, ui.shareLink.Url, 16, false)
+				})
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Bottom: unit.Dp(20)}.Layout(gtx, func(gtx C) D {
+				return Text(gtx, ui.styles, expires, 14, false)
+			})
+		}),
+		layout.Rigid(func(gtx C) D {
+			return TextButton(gtx, ui.styles, "Stop sharing", 16, true,
+				false, true, &ui.buttons[UNSHARE_BTN])
+		}),
+	)
+}
+
+// Add a device by its address or pairing code, showing ours for the other way around
+func (ui *UI) drawAddPeerPage(gtx C) D {
+	return layout.Flex{
+		Axis:      layout.Vertical,
+		Spacing:   layout.SpaceEnd,
+		Alignment: layout.Middle,
+	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Bottom: unit.Dp(12)}.Layout(gtx, func(gtx C) D {
+				return Text(gtx, ui.styles, "Add a device that isn't showing up", 24, false)
+			})
+		}),
+		layout.Rigid(func(gtx C) D {
+			return TextField(gtx, ui.styles, &ui.peerEditor,
+				"Its address, like 192.168.1.5:8000, or its pairing code")
+		}),
+		layout.Rigid(func(gtx C) D {
+			return TextButton(gtx, ui.styles, "Add", 16, false,
+				false, true, &ui.buttons[ADD_PEER_BTN])
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Top: unit.Dp(30), Bottom: unit.Dp(12)}.Layout(gtx,
+				func(gtx C) D {
+					return Text(gtx, ui.styles,
+						"Or scan or paste this device's pairing code on the other one", 16, false)
+				})
+		}),
+		layout.Rigid(func(gtx C) D {
+			size := min(gtx.Constraints.Max.X, gtx.Dp(unit.Dp(220)))
+			gtx.Constraints = layout.Exact(image.Pt(size, size))
+			return widget.Image{
+				Src: ui.pairingQR, Fit: widget.Contain, Position: layout.Center,
+			}.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Top: unit.Dp(12)}.Layout(gtx, func(gtx C) D {
+				return Text(gtx, ui.styles, ui.pairingCode, 12, false)
+			})
+		}),
+	)
+}
+
 func (ui *UI) drawSettingsPage(gtx C) D {
 	return layout.Flex{
 		Axis:      layout.Vertical,
 		Spacing:   layout.SpaceEnd,
 		Alignment: layout.Middle,
 	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D { // the name other devices see
+			return TextField(gtx, ui.styles, &ui.nameEditor, "Device name")
+		}),
 		layout.Rigid(func(gtx C) D { // toggle theme
 			return Checkbox(gtx, ui.styles, &ui.settings.DarkMode,
 				ui.icons[CHECK_ICON], "Dark mode")
@@ -605,9 +1246,47 @@ func (ui *UI) drawSettingsPage(gtx C) D {
 			return Checkbox(gtx, ui.styles, &ui.settings.NotifyUser,
 				ui.icons[CHECK_ICON], "Show notifications")
 		}),
-		layout.Rigid(func(gtx C) D { // trust recipients
+		layout.Rigid(func(gtx C) D { // auto accept from paired devices
 			return Checkbox(gtx, ui.styles, &ui.settings.TrustPeers,
-				ui.icons[CHECK_ICON], "Trust previous senders")
+				ui.icons[CHECK_ICON], "Trust paired devices")
+		}),
+		layout.Rigid(func(gtx C) D { // symlinks in folders being sent
+			if ui.isAndroid {
+				return layout.Dimensions{}
+			}
+			return Checkbox(gtx, ui.styles, &ui.settings.FollowSymlinks,
+				ui.icons[CHECK_ICON], "Send the files symlinks point to")
+		}),
+		layout.Rigid(func(gtx C) D { // only connect over the local network
+			return Checkbox(gtx, ui.styles, &ui.settings.LanOnly,
+				ui.icons[CHECK_ICON], "Local network only (applies after restart)")
+		}),
+		layout.Rigid(func(gtx C) D { // speak LocalSend's protocol too
+			return Checkbox(gtx, ui.styles, &ui.settings.LocalSend,
+				ui.icons[CHECK_ICON], "Work with LocalSend apps (applies after restart)")
+		}),
+		layout.Rigid(func(gtx C) D { // stun and turn servers
+			if ui.settings.LanOnly.Value {
+				return layout.Dimensions{}
+			}
+			return TextField(gtx, ui.styles, &ui.iceEditor, "ICE servers")
+		}),
+		layout.Rigid(func(gtx C) D { // bandwidth limits
+			return TextField(gtx, ui.styles, &ui.limitEditors[0], "Upload limit in KB/s")
+		}),
+		layout.Rigid(func(gtx C) D {
+			return TextField(gtx, ui.styles, &ui.limitEditors[1], "Upload limit per device in KB/s")
+		}),
+		layout.Rigid(func(gtx C) D {
+			return Checkbox(gtx, ui.styles, &ui.settings.LimitWorkHours,
+				ui.icons[CHECK_ICON], "Only limit uploads during working hours")
+		}),
+		layout.Rigid(func(gtx C) D { // local http api for scripts
+			if ui.isAndroid {
+				return layout.Dimensions{}
+			}
+			return Checkbox(gtx, ui.styles, &ui.settings.ControlAPI,
+				ui.icons[CHECK_ICON], "Let scripts control the app (applies after restart)")
 		}),
 		layout.Rigid(func(gtx C) D { // choose download path
 			// folder selection will be a desktop only feature
@@ -662,9 +1341,9 @@ func (ui *UI) drawFolderPicker(gtx C) D {
 				}.Layout(gtx,
 					layout.Rigid(func(gtx C) D {
 						proportional :=
-							20 - (0.1 * float32(len(ui.settings.DownloadPath)))
+							20 - (0.1 * float32(len(ui.pickerPath)))
 						size := int(max(12, proportional))
-						return Text(gtx, ui.styles, ui.settings.DownloadPath, size, false)
+						return Text(gtx, ui.styles, ui.pickerPath, size, false)
 					}),
 
 					layout.Rigid(func(gtx C) D {
@@ -691,6 +1370,33 @@ func (ui *UI) drawFolderPicker(gtx C) D {
 	})
 }
 
+func (ui *UI) drawRequestFile(gtx C, file *Item) D {
+	label := file.name
+	if !strings.HasSuffix(file.name, "/") {
+		label = fmt.Sprintf("%s (%s)", file.name, p2p.FormatBytes(float64(file.size)))
+	}
+
+	return layout.Flex{
+		Axis:      layout.Horizontal,
+		Alignment: layout.Middle,
+	}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			if file.thumbnail.Size() == (image.Point{}) {
+				return layout.Dimensions{}
+			}
+			return layout.Inset{Right: unit.Dp(14), Bottom: unit.Dp(20)}.Layout(gtx,
+				func(gtx C) D {
+					size := gtx.Dp(unit.Dp(40))
+					gtx.Constraints = layout.Exact(image.Pt(size, size))
+					return widget.Image{Src: file.thumbnail, Fit: widget.Contain}.Layout(gtx)
+				})
+		}),
+		layout.Rigid(func(gtx C) D {
+			return Checkbox(gtx, ui.styles, &file.check, ui.icons[CHECK_ICON], label)
+		}),
+	)
+}
+
 func (ui *UI) drawPermissionPage(gtx C) D {
 	return Modal(gtx, ui.styles, func(gtx C) D {
 		return XCentered(gtx, true, func(gtx C) D {
@@ -709,6 +1415,16 @@ func (ui *UI) drawPermissionPage(gtx C) D {
 					return layout.Spacer{Height: unit.Dp(30)}.Layout(gtx)
 				}),
 
+				layout.Flexed(1, func(gtx C) D { // the files being offered
+					if len(ui.requestFiles) == 0 {
+						return layout.Dimensions{}
+					}
+					return material.List(ui.styles.theme, ui.requestList).Layout(gtx,
+						len(ui.requestFiles), func(gtx C, i int) D {
+							return ui.drawRequestFile(gtx, &ui.requestFiles[i])
+						})
+				}),
+
 				layout.Rigid(func(gtx C) D {
 					return TextButton(gtx, ui.styles, "Yes", 18,
 						false, false, true, &ui.buttons[ACCEPT_BTN])
@@ -214,6 +214,24 @@ func Checkbox(
 	})
 }
 
+func TextField(gtx C, styles Styles, editor *widget.Editor, hint string) D {
+	return Div{
+		padding:      layout.UniformInset(unit.Dp(10)),
+		margin:       layout.Inset{Bottom: unit.Dp(20)},
+		background:   styles.bg500,
+		borderColor:  styles.border500,
+		borderRadius: styles.rounding,
+		borderWidth:  styles.borderWidth,
+	}.Layout(gtx, func(gtx C) D {
+		gtx.Constraints.Min.X = gtx.Constraints.Max.X
+		style := material.Editor(styles.theme, editor, hint)
+		style.Color = styles.fg500
+		style.HintColor = styles.fg400
+		style.TextSize = unit.Sp(18)
+		return style.Layout(gtx)
+	})
+}
+
 type Button struct {
 	bgColor       color.NRGBA
 	borderColor   color.NRGBA